@@ -0,0 +1,235 @@
+/*
+bilies-go - Bulk Insert Logs Into ElasticSearch
+Copyright (C) 2016 Adirelle <adirelle@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+/*
+
+Write aliases
+
+Instead of daily indices, the documents can be sent to a write alias. In that mode, the "date" of the messages is
+not needed and --index is ignored. At startup, bilies-go checks that the alias exists and has a write index
+("is_write_index": true). See the bootstrapping switches. The write alias can be set for a given output with
+--output-option, e.g. "siem:write-alias=audit".
+
+bilies-go can also roll the alias over, when any of the rollover conditions are met. The conditions are
+evaluated by ElasticSearch, bilies-go only asks for a rollover at regular interval, and as soon as the bulk
+responses show that the document limit is close. The documents already in the write index are counted at
+startup.
+
+The following switches control the write aliases:
+
+	--write-alias=STRING [default: none]
+		Name of the write alias.
+
+	--rollover-max-docs=INT [default: 0]
+		Roll over when the write index holds that number of documents.
+
+	--rollover-max-size=STRING [default: none]
+		Roll over when the write index reaches that size, e.g. "50gb".
+
+	--rollover-max-age=STRING [default: none]
+		Roll over when the write index is that old, e.g. "1d".
+
+	--rollover-check-interval=DURATION [default: 5m]
+		Delay between two rollover requests.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/spf13/pflag"
+
+	"github.com/Adirelle/bilies-go/data"
+)
+
+var (
+	writeAlias            string
+	rolloverMaxDocs       int64
+	rolloverMaxSize       string
+	rolloverMaxAge        string
+	rolloverCheckInterval = 5 * time.Minute
+
+	mRollover         = metrics.NewPrefixedChildRegistry(mRoot, "rollover.")
+	mRolloverRequests = metrics.GetOrRegisterMeter("requests", mRollover)
+	mRolloverDone     = metrics.GetOrRegisterMeter("done", mRollover)
+)
+
+func init() {
+	pflag.StringVar(&writeAlias, "write-alias", writeAlias, "Name of the write alias")
+	pflag.Int64Var(&rolloverMaxDocs, "rollover-max-docs", rolloverMaxDocs, "Roll over when the write index holds that number of documents")
+	pflag.StringVar(&rolloverMaxSize, "rollover-max-size", rolloverMaxSize, "Roll over when the write index reaches that size")
+	pflag.StringVar(&rolloverMaxAge, "rollover-max-age", rolloverMaxAge, "Roll over when the write index is that old")
+	pflag.DurationVar(&rolloverCheckInterval, "rollover-check-interval", rolloverCheckInterval, "Delay between rollover requests")
+}
+
+// WriteIndex returns the write index of an alias, checking that the alias exists and has one.
+func (u *BackendURL) WriteIndex(alias string) (string, error) {
+	var indices map[string]struct {
+		Aliases map[string]struct {
+			IsWriteIndex *bool `json:"is_write_index"`
+		} `json:"aliases"`
+	}
+	if err := u.Do("GET", "_alias/"+alias, nil, &indices); err != nil {
+		if isNotFound(err) {
+			return "", fmt.Errorf("The write alias %q does not exist", alias)
+		}
+		return "", err
+	}
+	for index, info := range indices {
+		if a, found := info.Aliases[alias]; found && a.IsWriteIndex != nil && *a.IsWriteIndex {
+			return index, nil
+		}
+	}
+	return "", fmt.Errorf("The alias %q has no write index", alias)
+}
+
+// CountDocuments returns the number of documents of an index.
+func (u *BackendURL) CountDocuments(index string) (int64, error) {
+	var counts []struct {
+		Count string `json:"count"`
+	}
+	if err := u.Do("GET", "_cat/count/"+index+"?format=json", nil, &counts); err != nil {
+		return 0, err
+	}
+	if len(counts) != 1 {
+		return 0, fmt.Errorf("Unexpected count of %q: %v", index, counts)
+	}
+	return strconv.ParseInt(counts[0].Count, 10, 64)
+}
+
+// RolloverConditions returns the rollover conditions, or nil if there is none.
+func RolloverConditions() map[string]interface{} {
+	conditions := map[string]interface{}{}
+	if rolloverMaxDocs > 0 {
+		conditions["max_docs"] = rolloverMaxDocs
+	}
+	if rolloverMaxSize != "" {
+		conditions["max_size"] = rolloverMaxSize
+	}
+	if rolloverMaxAge != "" {
+		conditions["max_age"] = rolloverMaxAge
+	}
+	if len(conditions) == 0 {
+		return nil
+	}
+	return conditions
+}
+
+// CountIndexedDocuments counts the documents indexed by a bulk request, and triggers a rollover request
+// when the document limit is close.
+func (o *Output) CountIndexedDocuments(resp *data.ESResponse) {
+	if o.writeAlias == "" || resp == nil {
+		return
+	}
+	n := int64(0)
+	for _, r := range resp.Items {
+		if s := r.Status(); s != nil && s.Status < 300 {
+			n++
+		}
+	}
+	if rolloverMaxDocs > 0 {
+		o.addRolloverDocs(n)
+	}
+}
+
+// addRolloverDocs counts documents of the write index, and triggers a rollover request when the document limit is
+// close.
+func (o *Output) addRolloverDocs(n int64) {
+	if atomic.AddInt64(&o.rolloverDocs, n) >= rolloverMaxDocs*9/10 {
+		select {
+		case o.rolloverTrigger <- true:
+		default:
+		}
+	}
+}
+
+// Rollover requests rollovers of the write alias. It is started by the requester, once the backend pool is ready.
+func (o *Output) Rollover() {
+	conditions := RolloverConditions()
+	if o.writeAlias == "" || conditions == nil {
+		return
+	}
+	body, err := json.Marshal(map[string]interface{}{"conditions": conditions})
+	if err != nil {
+		logger.Fatalf("Invalid rollover conditions: %s", err)
+	}
+
+	if rolloverMaxDocs > 0 {
+		o.seedRolloverDocs()
+	}
+
+	ticker := time.NewTicker(rolloverCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-o.rolloverTrigger:
+		case <-done:
+			return
+		}
+		mRolloverRequests.Mark(1)
+		err := o.pool.WithBackend(func(u *BackendURL) error {
+			var result struct {
+				RolledOver bool   `json:"rolled_over"`
+				OldIndex   string `json:"old_index"`
+				NewIndex   string `json:"new_index"`
+			}
+			if err := u.Do("POST", o.writeAlias+"/_rollover", body, &result); err != nil {
+				return err
+			}
+			if result.RolledOver {
+				// The new write index is empty
+				atomic.StoreInt64(&o.rolloverDocs, 0)
+				mRolloverDone.Mark(1)
+				logger.Noticef("Rolled %q over from %q to %q", o.writeAlias, result.OldIndex, result.NewIndex)
+			} else {
+				logger.Debugf("No rollover needed for %q", o.writeAlias)
+			}
+			return nil
+		})
+		if err != nil {
+			logger.Errorf("Could not roll %q over on %s: %s", o.writeAlias, o, err)
+		}
+	}
+}
+
+// seedRolloverDocs counts the documents already in the write index, so the document limit is detected even
+// after a restart.
+func (o *Output) seedRolloverDocs() {
+	err := o.pool.WithBackend(func(u *BackendURL) error {
+		index, err := u.WriteIndex(o.writeAlias)
+		if err != nil {
+			return err
+		}
+		count, err := u.CountDocuments(index)
+		if err != nil {
+			return err
+		}
+		logger.Infof("The write index %q of %q holds %d documents", index, o.writeAlias, count)
+		o.addRolloverDocs(count)
+		return nil
+	})
+	if err != nil {
+		logger.Errorf("Could not count the documents of %q on %s: %s", o.writeAlias, o, err)
+	}
+}
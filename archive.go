@@ -0,0 +1,335 @@
+/*
+bilies-go - Bulk Insert Logs Into ElasticSearch
+Copyright (C) 2016 Adirelle <adirelle@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+/*
+
+File outputs
+
+An output can write the messages into local files instead of sending them to a cluster, e.g. to keep archives.
+Its URL is the directory of the files, e.g. "--output=archive=file:///var/lib/bilies/archive". Like with the
+other outputs, the messages are removed from the queue once they have been written and synced to the disk.
+
+The files are named "OUTPUT-YYYYMMDD-HHMMSS.mmm.ndjson", with a ".gz" extension when they are compressed. The
+messages are written either in the input format, so the files can be fed back to bilies-go, or as the bodies of
+the bulk requests, as they would have been sent to ElasticSearch. Each batch is compressed as a gzip member of its
+own, which gzip reads as a single stream. When a batch cannot be written, the file is truncated to its previous
+size and the batch is written again into a new file.
+
+The following switches control the file outputs. They can be set for a given output with --output-option.
+
+	--file-format=(records|bulk) [default: records]
+		Format of the files: "records" for the input format, "bulk" for the bodies of the bulk requests.
+
+	--file-rotate-size=INT [default: 104857600]
+		Start a new file when the current one holds that number of bytes, before compression (0 for no limit).
+
+	--file-rotate-interval=DURATION [default: 1h]
+		Start a new file when the current one is that old (0 for no limit).
+
+	--file-gzip [default: true]
+		Compress the files with gzip.
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/spf13/pflag"
+)
+
+var (
+	fileFormat               = "records"
+	fileRotateSize     int64 = 100 * 1024 * 1024
+	fileRotateInterval       = time.Hour
+	fileGzip                 = true
+)
+
+func init() {
+	pflag.StringVar(&fileFormat, "file-format", fileFormat, "Format of the file outputs: records | bulk")
+	pflag.Int64Var(&fileRotateSize, "file-rotate-size", fileRotateSize, "Maximum size of the files, before compression (0 for no limit)")
+	pflag.DurationVar(&fileRotateInterval, "file-rotate-interval", fileRotateInterval, "Maximum age of the files (0 for no limit)")
+	pflag.BoolVar(&fileGzip, "file-gzip", fileGzip, "Compress the files with gzip")
+}
+
+// ParseFileURL returns the directory of a file output URL, e.g. "file:///var/archive".
+func ParseFileURL(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	dir := u.Path
+	if u.Opaque != "" {
+		dir = u.Opaque
+	}
+	if u.Scheme != "file" || dir == "" || (u.Host != "" && u.Host != "localhost") {
+		return "", fmt.Errorf("Invalid file URL %q", rawURL)
+	}
+	return dir, nil
+}
+
+// FileArchive writes batchs into rotated files.
+type FileArchive struct {
+	dir      string
+	prefix   string
+	format   string
+	maxSize  int64
+	maxAge   time.Duration
+	compress bool
+
+	path     string
+	file     *os.File
+	buffered *bufio.Writer
+	gz       *gzip.Writer
+	size     int64
+	openedAt time.Time
+
+	mBytes     metrics.Meter
+	mFiles     metrics.Meter
+	mErrors    metrics.Meter
+	mWriteTime metrics.Timer
+}
+
+// NewFileArchive creates the archive of a file output.
+func NewFileArchive(o *Output) (*FileArchive, error) {
+	if o.fileFormat != "records" && o.fileFormat != "bulk" {
+		return nil, fmt.Errorf("Unknown file format %q", o.fileFormat)
+	}
+	if err := os.MkdirAll(o.dir, 0755); err != nil {
+		return nil, err
+	}
+	registry := metrics.NewPrefixedChildRegistry(o.metrics, "file.")
+	return &FileArchive{
+		dir:        o.dir,
+		prefix:     o.Name,
+		format:     o.fileFormat,
+		maxSize:    o.fileRotateSize,
+		maxAge:     o.fileRotateInterval,
+		compress:   o.fileGzip,
+		mBytes:     metrics.GetOrRegisterMeter("bytes", registry),
+		mFiles:     metrics.GetOrRegisterMeter("files", registry),
+		mErrors:    metrics.GetOrRegisterMeter("errors", registry),
+		mWriteTime: metrics.GetOrRegisterTimer("write.time", registry),
+	}, nil
+}
+
+// Encode returns the data to write for a batch.
+func (a *FileArchive) Encode(buf *IndexedBuffer) ([]byte, error) {
+	if a.format == "bulk" {
+		return buf.Bytes(), nil
+	}
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	for _, rec := range buf.Records(0, buf.Count()) {
+		if err := enc.Encode(rec.InputRecord()); err != nil {
+			return nil, err
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// Write writes the data of a batch, rotating the file if needed, and syncs it to the disk.
+func (a *FileArchive) Write(data []byte, now time.Time) error {
+	if a.file != nil && (a.isOld(now) || (a.maxSize > 0 && a.size > 0 && a.size+int64(len(data)) > a.maxSize)) {
+		if err := a.Close(); err != nil {
+			return err
+		}
+	}
+	if a.file == nil {
+		if err := a.open(now); err != nil {
+			return err
+		}
+	}
+
+	start := time.Now()
+	offset, err := a.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if err := a.write(data); err != nil {
+		return a.fail(offset, err)
+	}
+	a.mWriteTime.UpdateSince(start)
+	a.size += int64(len(data))
+	a.mBytes.Mark(int64(len(data)))
+	return nil
+}
+
+// write writes the data and syncs the file. When compressing, the data is written as a gzip member of its own, so
+// the file can be truncated between two batchs.
+func (a *FileArchive) write(data []byte) error {
+	w := io.Writer(a.buffered)
+	if a.gz != nil {
+		a.gz.Reset(a.buffered)
+		w = a.gz
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if a.gz != nil {
+		if err := a.gz.Close(); err != nil {
+			return err
+		}
+	}
+	if err := a.buffered.Flush(); err != nil {
+		return err
+	}
+	return a.file.Sync()
+}
+
+// Rotate closes the current file if it is too old.
+func (a *FileArchive) Rotate(now time.Time) error {
+	if a.file == nil || !a.isOld(now) {
+		return nil
+	}
+	return a.Close()
+}
+
+// Close closes the current file, if any.
+func (a *FileArchive) Close() error {
+	if a.file == nil {
+		return nil
+	}
+	err := a.buffered.Flush()
+	if e := a.file.Sync(); err == nil {
+		err = e
+	}
+	if e := a.file.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		logger.Infof("Closed %q, %d bytes", a.path, a.size)
+	} else {
+		a.mErrors.Mark(1)
+	}
+	a.file, a.buffered, a.gz = nil, nil, nil
+	return err
+}
+
+func (a *FileArchive) isOld(now time.Time) bool {
+	return a.maxAge > 0 && now.Sub(a.openedAt) >= a.maxAge
+}
+
+func (a *FileArchive) open(now time.Time) (err error) {
+	name := fmt.Sprintf("%s-%s.ndjson", a.prefix, now.Format("20060102-150405.000"))
+	if a.compress {
+		name += ".gz"
+	}
+	a.path = filepath.Join(a.dir, name)
+	if a.file, err = os.OpenFile(a.path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644); err != nil {
+		a.file = nil
+		a.mErrors.Mark(1)
+		return
+	}
+	a.buffered = bufio.NewWriter(a.file)
+	if a.compress {
+		a.gz = gzip.NewWriter(a.buffered)
+	}
+	a.size = 0
+	a.openedAt = now
+	a.mFiles.Mark(1)
+	logger.Infof("Writing into %q", a.path)
+	return
+}
+
+// fail truncates the current file to its size before the failed batch, and closes it, so the batch is written
+// into a new file without leaving a partial copy behind. An empty file is removed.
+func (a *FileArchive) fail(offset int64, err error) error {
+	a.mErrors.Mark(1)
+	if e := a.file.Truncate(offset); e != nil {
+		logger.Errorf("Could not truncate %q, it may hold a partial batch: %s", a.path, e)
+	} else if e = a.file.Sync(); e != nil {
+		logger.Errorf("Could not sync %q, it may hold a partial batch: %s", a.path, e)
+	}
+	if e := a.file.Close(); e != nil {
+		logger.Errorf("Could not close %q: %s", a.path, e)
+	}
+	if offset == 0 {
+		if e := os.Remove(a.path); e != nil {
+			logger.Errorf("Could not remove %q: %s", a.path, e)
+		}
+	}
+	a.file, a.buffered, a.gz = nil, nil, nil
+	return err
+}
+
+// Archiver writes the batchs of a file output.
+func (o *Output) Archiver() {
+	archive, err := NewFileArchive(o)
+	if err != nil {
+		logger.Fatalf("Invalid file output %s: %s", o, err)
+	}
+	defer func() {
+		if err := archive.Close(); err != nil {
+			logger.Errorf("Could not close %q: %s", archive.path, err)
+		}
+	}()
+
+	var rotation <-chan time.Time
+	if o.fileRotateInterval > 0 {
+		t := time.NewTicker(o.fileRotateInterval / 10)
+		defer t.Stop()
+		rotation = t.C
+	}
+
+	for {
+		select {
+		case buf, ok := <-o.batchs:
+			if !ok {
+				return
+			}
+			data, err := archive.Encode(&buf)
+			if err != nil {
+				logger.Errorf("Could not encode batch %s for %s: %s", buf.ID, o, err)
+				break
+			}
+			if !o.WaitForRateLimits(buf.Count(), len(data)) {
+				return
+			}
+			var delay time.Duration
+			for failures := 1; ; failures++ {
+				if err = archive.Write(data, time.Now()); err == nil {
+					break
+				}
+				delay = BackoffDelay(failures, delay)
+				logger.Errorf("Could not write batch %s to %s, retrying in %s: %s", buf.ID, o, delay, err)
+				select {
+				case <-time.After(delay):
+				case <-done:
+					return
+				}
+			}
+			logger.Debugf("Wrote batch %s to %q", buf.ID, archive.path)
+			o.AckRecords(buf.QueueKeys(0, buf.Count()))
+		case now := <-rotation:
+			if err = archive.Rotate(now); err != nil {
+				logger.Errorf("Could not close %q: %s", archive.path, err)
+			}
+		}
+	}
+}
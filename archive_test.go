@@ -0,0 +1,146 @@
+/*
+bilies-go - Bulk Insert Logs Into ElasticSearch
+Copyright (C) 2016 Adirelle <adirelle@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Adirelle/bilies-go/data"
+)
+
+func newTestArchive(t *testing.T, gzip bool) *FileArchive {
+	o := NewOutput("archive", nil)
+	o.dir, o.fileFormat, o.fileGzip = t.TempDir(), "records", gzip
+	a, err := NewFileArchive(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func archiveBatch(t *testing.T, a *FileArchive, docs ...string) []byte {
+	buf := MakeIndexedBuffer(len(docs))
+	for _, doc := range docs {
+		buf.Mark(data.Record{ID: doc, Suffix: "2016.10.01", Document: `{"msg":"` + doc + `"}`})
+	}
+	data, err := a.Encode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func readArchive(t *testing.T, path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("%s: %s", path, err)
+	}
+	return string(content)
+}
+
+const (
+	archiveA = `{"id":"a","date":"2016.10.01","log":{"msg":"a"}}` + "\n"
+	archiveB = `{"id":"b","date":"2016.10.01","log":{"msg":"b"}}` + "\n"
+)
+
+func TestFileArchiveGzipMembers(t *testing.T) {
+	a := newTestArchive(t, true)
+	now := time.Now()
+	if err := a.Write(archiveBatch(t, a, "a"), now); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Write(archiveBatch(t, a, "b"), now); err != nil {
+		t.Fatal(err)
+	}
+	// The file is readable before being closed
+	if content := readArchive(t, a.path); content != archiveA+archiveB {
+		t.Errorf("unexpected content %q", content)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if content := readArchive(t, a.path); content != archiveA+archiveB {
+		t.Errorf("unexpected content %q", content)
+	}
+}
+
+func TestFileArchiveFailTruncates(t *testing.T) {
+	a := newTestArchive(t, true)
+	now := time.Now()
+	if err := a.Write(archiveBatch(t, a, "a"), now); err != nil {
+		t.Fatal(err)
+	}
+	path := a.path
+
+	// Simulate a batch partially written before an error
+	offset, _ := a.file.Seek(0, io.SeekCurrent)
+	a.buffered.WriteString("partial batch")
+	a.buffered.Flush()
+	if err := a.fail(offset, errors.New("disk full")); err == nil {
+		t.Fatal("expected the error to be returned")
+	}
+	if content := readArchive(t, path); content != archiveA {
+		t.Errorf("expected the partial batch to be removed, got %q", content)
+	}
+
+	// The batch is written again into a new file
+	if err := a.Write(archiveBatch(t, a, "b"), now.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if a.path == path {
+		t.Fatal("expected a new file")
+	}
+	a.Close()
+	if content := readArchive(t, a.path); content != archiveB {
+		t.Errorf("unexpected content %q", content)
+	}
+}
+
+func TestFileArchiveFailRemovesEmptyFile(t *testing.T) {
+	a := newTestArchive(t, false)
+	if err := a.open(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	path := a.path
+	a.buffered.WriteString("partial batch")
+	a.buffered.Flush()
+	a.fail(0, errors.New("disk full"))
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected %q to be removed, got %v", path, err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(a.dir, "*")); len(files) != 0 {
+		t.Errorf("unexpected files %v", files)
+	}
+}
@@ -0,0 +1,213 @@
+/*
+bilies-go - Bulk Insert Logs Into ElasticSearch
+Copyright (C) 2016 Adirelle <adirelle@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+/*
+
+Authentication
+
+bilies-go supports HTTP basic authentication, ElasticSearch API keys and bearer tokens. If several are
+configured, the bearer token is used first, then the API key, then the basic authentication.
+
+To keep secrets off the command line, they can be read from files or from the BILIES_PASSWD, BILIES_API_KEY
+and BILIES_BEARER_TOKEN environment variables. The files are read again at regular interval, so rotated
+secrets are picked up without restarting.
+
+The following switches control authentication, in addition to --user and --passwd:
+
+	--passwd-file=STRING [default: none]
+		Read the password for basic authentication from the file.
+
+	--api-key=STRING [default: $BILIES_API_KEY]
+		ElasticSearch API key, either as "id:key" or already encoded in base64.
+
+	--api-key-file=STRING [default: none]
+		Read the API key from the file.
+
+	--bearer-token=STRING [default: $BILIES_BEARER_TOKEN]
+		Bearer token.
+
+	--bearer-token-file=STRING [default: none]
+		Read the bearer token from the file.
+
+	--credentials-refresh=DURATION [default: 1m]
+		Delay between two readings of the credential files.
+*/
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+var (
+	credentialsRefresh = time.Minute
+
+	credentials = &Credentials{}
+)
+
+func init() {
+	credentials.Sources.AddFlags(pflag.CommandLine)
+	pflag.DurationVar(&credentialsRefresh, "credentials-refresh", credentialsRefresh, "Delay between readings of credential files")
+
+	AddBackgroundTask("Credentials refresher", CredentialsRefresher)
+}
+
+// CredentialSources tells where to find the credentials.
+type CredentialSources struct {
+	Username        string
+	Password        string
+	PasswordFile    string
+	APIKey          string
+	APIKeyFile      string
+	BearerToken     string
+	BearerTokenFile string
+}
+
+// AddFlags adds the switches of the sources to the flag set.
+func (s *CredentialSources) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVarP(&s.Username, "user", "u", s.Username, "Username for authentication")
+	fs.StringVarP(&s.Password, "passwd", "w", s.Password, "Password for authentication")
+	fs.StringVar(&s.PasswordFile, "passwd-file", s.PasswordFile, "Read the password from that file")
+	fs.StringVar(&s.APIKey, "api-key", s.APIKey, "ElasticSearch API key")
+	fs.StringVar(&s.APIKeyFile, "api-key-file", s.APIKeyFile, "Read the ElasticSearch API key from that file")
+	fs.StringVar(&s.BearerToken, "bearer-token", s.BearerToken, "Bearer token")
+	fs.StringVar(&s.BearerTokenFile, "bearer-token-file", s.BearerTokenFile, "Read the bearer token from that file")
+}
+
+// HasFiles tells whether some credentials are read from files.
+func (s CredentialSources) HasFiles() bool {
+	return s.PasswordFile != "" || s.APIKeyFile != "" || s.BearerTokenFile != ""
+}
+
+// Credentials holds the current credentials.
+type Credentials struct {
+	Sources CredentialSources
+
+	username    string
+	password    string
+	apiKey      string
+	bearerToken string
+	sync.RWMutex
+}
+
+// Load (re)loads the credentials from the command line, the environment and the files.
+func (c *Credentials) Load() error {
+	var err error
+	passwd := secret(c.Sources.Password, "BILIES_PASSWD")
+	if passwd, err = readSecret(c.Sources.PasswordFile, passwd); err != nil {
+		return err
+	}
+	key := secret(c.Sources.APIKey, "BILIES_API_KEY")
+	if key, err = readSecret(c.Sources.APIKeyFile, key); err != nil {
+		return err
+	}
+	if strings.Contains(key, ":") {
+		key = base64.StdEncoding.EncodeToString([]byte(key))
+	}
+	token := secret(c.Sources.BearerToken, "BILIES_BEARER_TOKEN")
+	if token, err = readSecret(c.Sources.BearerTokenFile, token); err != nil {
+		return err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.username = c.Sources.Username
+	c.password = passwd
+	c.apiKey = key
+	c.bearerToken = token
+	return nil
+}
+
+// Apply adds the authentication header to the request.
+func (c *Credentials) Apply(req *http.Request) {
+	c.RLock()
+	defer c.RUnlock()
+	switch {
+	case c.bearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+c.bearerToken)
+	case c.apiKey != "":
+		req.Header.Set("Authorization", "ApiKey "+c.apiKey)
+	case c.username != "":
+		req.SetBasicAuth(c.username, c.password)
+	}
+}
+
+// CredentialsRefresher reads the credential files at regular interval.
+func CredentialsRefresher() {
+	var refreshed []*Credentials
+	for _, c := range AllCredentials() {
+		if c.Sources.HasFiles() {
+			refreshed = append(refreshed, c)
+		}
+	}
+	if len(refreshed) == 0 || credentialsRefresh <= 0 {
+		return
+	}
+	t := time.NewTicker(credentialsRefresh)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			for _, c := range refreshed {
+				if err := c.Load(); err != nil {
+					logger.Errorf("Could not read credentials, keeping the previous ones: %s", err)
+				}
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// AllCredentials returns the credentials of all the outputs.
+func AllCredentials() []*Credentials {
+	all := []*Credentials{credentials}
+	for _, o := range outputs {
+		if o.credentials != credentials {
+			all = append(all, o.credentials)
+		}
+	}
+	return all
+}
+
+// secret returns the value, or the content of the environment variable if empty.
+func secret(value string, envVar string) string {
+	if value != "" {
+		return value
+	}
+	return os.Getenv(envVar)
+}
+
+// readSecret returns the content of the file, or the default value if there is no file.
+func readSecret(path string, def string) (string, error) {
+	if path == "" {
+		return def, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
@@ -20,14 +20,14 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 
 Batchs
 
-Messages are gathered in batchs before being sent to the server.
+Messages are gathered in batchs before being sent to the server. Each output has its own batchs.
 Batchs are sent when the number of messages reachs a defined value or when the delay
 since the last sent exceeds a defined value.
 
 The following switches control the generation of bulk messages:
 
 	-i --index=STRING [default: logs]
-		Define the prefix of the index name.
+		Define the prefix of the index name. See also --data-stream and --write-alias.
 
 	-t --type=STRING [default: log]
 		Define the type of messages.
@@ -37,11 +37,29 @@ The following switches control the generation of bulk messages:
 
 	-f --flush-delay=DURATION [default: 1s]
 		The maximum delay between two requests.
+
+The size of the batchs can also be adapted to the cluster: it grows while the requests are faster than a target
+latency, and shrinks when they are slower, when the cluster rejects records because it is overloaded (429) or when
+a request is too large (413). The following switches control the adaptive mode:
+
+	--batch-adaptive [default: false]
+		Enable the adaptive mode. The initial size is set by --batch-size.
+
+	--batch-min-size=INT [default: 50]
+		The minimum number of messages in a batch.
+
+	--batch-max-size=INT [default: 5000]
+		The maximum number of messages in a batch.
+
+	--batch-target-latency=DURATION [default: 1s]
+		The expected request time.
 */
 package main
 
 import (
 	"fmt"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/rcrowley/go-metrics"
@@ -55,13 +73,16 @@ var (
 	batchSize  = 500
 	flushDelay = 1 * time.Second
 
+	adaptiveBatch      bool
+	batchMinSize       = 50
+	batchMaxSize       = 5000
+	batchTargetLatency = 1 * time.Second
+
 	mBatcher      = metrics.NewPrefixedChildRegistry(mRoot, "batcher.")
 	mBatchRecords = metrics.NewRegisteredMeter("records", mBatcher)
 	mBatchBytes   = metrics.NewRegisteredMeter("bytes", mBatcher)
 	mBatchErrors  = metrics.NewRegisteredMeter("errors", mBatcher)
 	mBatchSize    = metrics.NewRegisteredHistogram("size", mBatcher, NewSample())
-
-	batchs = make(chan IndexedBuffer)
 )
 
 func init() {
@@ -69,49 +90,72 @@ func init() {
 	pflag.StringVarP(&docType, "type", "t", docType, "Document type")
 	pflag.IntVarP(&batchSize, "batch-size", "n", batchSize, "Maximum number of events in a batch")
 	pflag.DurationVarP(&flushDelay, "flush-delay", "f", flushDelay, "Maximum delay between flushs")
-
-	AddMainTask("Batcher", Batcher)
+	pflag.BoolVar(&adaptiveBatch, "batch-adaptive", adaptiveBatch, "Adapt the batch size to the cluster")
+	pflag.IntVar(&batchMinSize, "batch-min-size", batchMinSize, "Minimum number of events in an adaptive batch")
+	pflag.IntVar(&batchMaxSize, "batch-max-size", batchMaxSize, "Maximum number of events in an adaptive batch")
+	pflag.DurationVar(&batchTargetLatency, "batch-target-latency", batchTargetLatency, "Expected request time of adaptive batchs")
 }
 
-func Batcher() {
-	defer close(batchs)
+// Batcher gathers the records read by the cursor of the output into batchs.
+func (o *Output) Batcher() {
+	defer close(o.batchs)
+
+	if adaptiveBatch && (batchMinSize < 1 || batchMaxSize < batchMinSize) {
+		logger.Fatalf("Invalid adaptive batch bounds: %d-%d", batchMinSize, batchMaxSize)
+	}
+	o.setBatchLimit(o.batchSize)
 
 	var (
-		input       = queue.ReadC
+		input       = o.cursor.ReadC
 		readerState = readerDone
-		buffer      = MakeIndexedBuffer(batchSize)
+		buffer      = MakeIndexedBuffer(o.BatchLimit())
 
 		output  chan<- IndexedBuffer
 		timeout <-chan time.Time
+		batchID uint64 = 1
 	)
+	buffer.ID = strconv.FormatUint(batchID, 10)
 
 	for {
 		select {
 		case rec := <-input:
-			_, err := fmt.Fprintf(&buffer, `{"index":{"_id":%q, "_index":"%s-%s","_type":"%s"}}`+"\n%s\n", rec.ID, indexPrefix, rec.Suffix, docType, rec.Document)
+			var id string
+			if rec.ID != "" {
+				id = fmt.Sprintf(`"_id":%q, `, rec.ID)
+			}
+			var err error
+			if o.dataStream != "" {
+				_, err = fmt.Fprintf(&buffer, `{"create":{%s"_index":"%s"}}`+"\n%s\n", id, o.dataStream, rec.Document)
+			} else if o.writeAlias != "" {
+				_, err = fmt.Fprintf(&buffer, `{"index":{%s"_index":"%s","_type":"%s"}}`+"\n%s\n", id, o.writeAlias, o.docType, rec.Document)
+			} else {
+				_, err = fmt.Fprintf(&buffer, `{"index":{%s"_index":"%s-%s","_type":"%s"}}`+"\n%s\n", id, o.indexPrefix, rec.Suffix, o.docType, rec.Document)
+			}
 			if err != nil {
 				mBatchErrors.Mark(1)
 				logger.Errorf("Could not write record: %s", err)
 				break
 			}
-			buffer.Mark(rec.ID)
-			if buffer.Count() >= batchSize {
+			buffer.Mark(rec)
+			if buffer.Count() >= o.BatchLimit() {
 				input = nil
-				output = batchs
+				output = o.batchs
 			}
 		case output <- buffer:
 			mBatchRecords.Mark(int64(buffer.Count()))
 			mBatchSize.Update(int64(buffer.Count()))
 			mBatchBytes.Mark(int64(buffer.Len()))
-			logger.Debugf("Sent batch, %d records, %d bytes", buffer.Count(), buffer.Len())
-			input = queue.ReadC
+			logger.Debugf("Sent batch %s to %s, %d records, %d bytes", buffer.ID, o, buffer.Count(), buffer.Len())
+			input = o.cursor.ReadC
 			output = nil
-			buffer = MakeIndexedBuffer(batchSize)
+			buffer = o.nextBuffer(&buffer)
+			batchID++
+			buffer.ID = strconv.FormatUint(batchID, 10)
 		case <-timeout:
 			timeout = nil
 			if buffer.Count() > 0 {
 				input = nil
-				output = batchs
+				output = o.batchs
 			} else if readerState == nil {
 				return
 			}
@@ -122,7 +166,57 @@ func Batcher() {
 			return
 		}
 		if input != nil && timeout == nil {
-			timeout = time.After(flushDelay)
+			timeout = time.After(o.flushDelay)
+		}
+	}
+}
+
+// nextBuffer creates the buffer of the next batch, sized for the current limit using the average size of the records
+// of the previous batch.
+func (o *Output) nextBuffer(prev *IndexedBuffer) IndexedBuffer {
+	n := o.BatchLimit()
+	if prev.Count() == 0 {
+		return MakeIndexedBuffer(n)
+	}
+	return MakeSizedIndexedBuffer(n, n*(prev.Len()/prev.Count()+1))
+}
+
+// BatchLimit returns the current maximum number of records in a batch.
+func (o *Output) BatchLimit() int {
+	return int(atomic.LoadInt64(&o.batchLimit))
+}
+
+// AdjustBatchLimit adapts the batch limit, in adaptive mode, using the outcome of a request of n records.
+func (o *Output) AdjustBatchLimit(n int, elapsed time.Duration, overloaded bool) {
+	if !adaptiveBatch {
+		return
+	}
+	limit := o.BatchLimit()
+	switch {
+	case overloaded:
+		limit /= 2
+	case elapsed > batchTargetLatency:
+		limit -= limit / 10
+	case n >= limit:
+		// Only grow when the batchs are full, else the limit is not the bottleneck
+		limit += limit/10 + 1
+	default:
+		return
+	}
+	if o.setBatchLimit(limit) != o.BatchLimit() {
+		logger.Debugf("Batch size limit of %s set to %d", o, o.BatchLimit())
+	}
+}
+
+// setBatchLimit updates the batch limit, within the bounds in adaptive mode. It returns the previous limit.
+func (o *Output) setBatchLimit(limit int) int {
+	if adaptiveBatch {
+		if limit < batchMinSize {
+			limit = batchMinSize
+		} else if limit > batchMaxSize {
+			limit = batchMaxSize
 		}
 	}
+	o.mBatchLimit.Update(int64(limit))
+	return int(atomic.SwapInt64(&o.batchLimit, int64(limit)))
 }
@@ -0,0 +1,374 @@
+/*
+bilies-go - Bulk Insert Logs Into ElasticSearch
+Copyright (C) 2016 Adirelle <adirelle@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+/*
+
+Bootstrapping
+
+At startup, bilies-go can install an index template and an ILM policy, so the new indices get the right mappings
+and settings. They are installed only if they are missing, or if the installed ones have a lower version, read from
+the "version" field of the template and from the "_meta.version" field of the policy. With several outputs,
+each cluster is bootstrapped.
+
+Composable templates are used with ElasticSearch 7.8 and later, legacy templates otherwise. The template file can
+use either format, it is converted as needed. If missing, the index patterns are set to match the indices of
+bilies-go, and the ILM policy is set in the settings of the template. With --data-stream, the template is set up
+for the data stream. With --write-alias, the alias is checked and set as the rollover alias of the ILM policy.
+
+The following switches control the bootstrapping:
+
+	--index-template=FILE [default: none]
+		JSON file of the index template.
+
+	--index-template-name=STRING [default: value of --data-stream or --index]
+		Name of the index template.
+
+	--ilm-policy=FILE [default: none]
+		JSON file of the ILM policy, as expected by the ILM API, i.e. {"policy": {...}}.
+
+	--ilm-policy-name=STRING [default: value of --data-stream or --index]
+		Name of the ILM policy.
+
+	--bootstrap-errors=(fatal|warn) [default: fatal]
+		Whether bootstrapping errors prevent bilies-go from starting.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+var (
+	indexTemplateFile string
+	indexTemplateName string
+	ilmPolicyFile     string
+	ilmPolicyName     string
+	bootstrapErrors   = "fatal"
+)
+
+func init() {
+	pflag.StringVar(&indexTemplateFile, "index-template", indexTemplateFile, "JSON file of the index template")
+	pflag.StringVar(&indexTemplateName, "index-template-name", indexTemplateName, "Name of the index template (default: index prefix)")
+	pflag.StringVar(&ilmPolicyFile, "ilm-policy", ilmPolicyFile, "JSON file of the ILM policy")
+	pflag.StringVar(&ilmPolicyName, "ilm-policy-name", ilmPolicyName, "Name of the ILM policy (default: index prefix)")
+	pflag.StringVar(&bootstrapErrors, "bootstrap-errors", bootstrapErrors, "Bootstrapping errors: fatal | warn")
+}
+
+// ClusterVersion is the version of the cluster.
+type ClusterVersion struct {
+	Number       string `json:"number"`
+	Distribution string `json:"distribution"`
+}
+
+// AtLeast tells whether the version is greater or equal to major.minor.
+func (v ClusterVersion) AtLeast(major, minor int) bool {
+	parts := strings.SplitN(v.Number, ".", 3)
+	actualMajor, _ := strconv.Atoi(parts[0])
+	actualMinor := 0
+	if len(parts) > 1 {
+		actualMinor, _ = strconv.Atoi(parts[1])
+	}
+	return actualMajor > major || (actualMajor == major && actualMinor >= minor)
+}
+
+func (v ClusterVersion) String() string {
+	if v.Distribution == "" {
+		return "elasticsearch " + v.Number
+	}
+	return v.Distribution + " " + v.Number
+}
+
+// IsOpenSearch tells whether the cluster runs OpenSearch.
+func (v ClusterVersion) IsOpenSearch() bool {
+	return v.Distribution == "opensearch"
+}
+
+// SetupBootstrap checks the bootstrapping switches and sets the default names.
+func SetupBootstrap() {
+	if bootstrapErrors != "fatal" && bootstrapErrors != "warn" {
+		logger.Fatalf("Invalid value for --bootstrap-errors: %q", bootstrapErrors)
+	}
+	for _, o := range outputs {
+		defaultName := o.indexPrefix
+		if o.dataStream != "" {
+			defaultName = o.dataStream
+		}
+		if o.indexTemplateName == "" {
+			o.indexTemplateName = defaultName
+		}
+		if o.ilmPolicyName == "" {
+			o.ilmPolicyName = defaultName
+		}
+	}
+}
+
+// Bootstrap installs the ILM policy and the index template, and checks the write alias, if needed.
+func (o *Output) Bootstrap() error {
+	if o.indexTemplateFile == "" && o.ilmPolicyFile == "" && o.writeAlias == "" {
+		return nil
+	}
+	return o.pool.WithBackend(o.bootstrap)
+}
+
+// bootstrap installs the ILM policy and the index template using the backend.
+func (o *Output) bootstrap(u *BackendURL) error {
+	var info struct {
+		Version ClusterVersion `json:"version"`
+	}
+	if err := u.Do("GET", "", nil, &info); err != nil {
+		return err
+	}
+	logger.Infof("Cluster version: %s", info.Version)
+
+	if o.writeAlias != "" {
+		index, err := u.WriteIndex(o.writeAlias)
+		if err != nil {
+			return err
+		}
+		logger.Infof("The write index of %q is %q", o.writeAlias, index)
+	}
+
+	if o.ilmPolicyFile != "" {
+		if info.Version.IsOpenSearch() || !info.Version.AtLeast(6, 6) {
+			return fmt.Errorf("ILM policies are not supported by %s", info.Version)
+		}
+		if err := o.installILMPolicy(u); err != nil {
+			return err
+		}
+	}
+	if o.indexTemplateFile != "" {
+		composable := info.Version.IsOpenSearch() || info.Version.AtLeast(7, 8)
+		if err := o.installIndexTemplate(u, composable); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *Output) installILMPolicy(u *BackendURL) error {
+	policy, err := readJSONObject(o.ilmPolicyFile)
+	if err != nil {
+		return err
+	}
+	wanted := jsonVersion(jsonObject(jsonObject(policy["policy"])["_meta"])["version"])
+
+	var installed map[string]struct {
+		Policy struct {
+			Meta struct {
+				Version *int64 `json:"version"`
+			} `json:"_meta"`
+		} `json:"policy"`
+	}
+	endpoint := "_ilm/policy/" + o.ilmPolicyName
+	if err := u.Do("GET", endpoint, nil, &installed); err != nil && !isNotFound(err) {
+		return err
+	}
+	var current *int64
+	p, found := installed[o.ilmPolicyName]
+	if found {
+		current = p.Policy.Meta.Version
+	}
+	return u.installIfNewer("ILM policy", o.ilmPolicyName, endpoint, policy, found, current, wanted)
+}
+
+func (o *Output) installIndexTemplate(u *BackendURL, composable bool) error {
+	template, err := readJSONObject(o.indexTemplateFile)
+	if err != nil {
+		return err
+	}
+	if composable {
+		template = toComposableTemplate(template)
+	} else {
+		template = toLegacyTemplate(template)
+	}
+	if _, found := template["index_patterns"]; !found {
+		if o.dataStream != "" {
+			template["index_patterns"] = []string{o.dataStream}
+		} else if o.writeAlias != "" {
+			template["index_patterns"] = []string{o.writeAlias + "-*"}
+		} else {
+			template["index_patterns"] = []string{o.indexPrefix + "-*"}
+		}
+	}
+	if _, found := template["data_stream"]; !found && o.dataStream != "" && composable {
+		template["data_stream"] = map[string]interface{}{}
+	}
+	if o.ilmPolicyFile != "" {
+		settings := template
+		if composable {
+			settings = jsonObject(template["template"])
+			template["template"] = settings
+		}
+		setILMPolicy(settings, "name", o.ilmPolicyName)
+		if o.writeAlias != "" && o.dataStream == "" {
+			setILMPolicy(settings, "rollover_alias", o.writeAlias)
+		}
+	}
+	wanted := jsonVersion(template["version"])
+
+	var (
+		endpoint string
+		found    bool
+		current  *int64
+	)
+	if composable {
+		endpoint = "_index_template/" + o.indexTemplateName
+		var installed struct {
+			IndexTemplates []struct {
+				IndexTemplate struct {
+					Version *int64 `json:"version"`
+				} `json:"index_template"`
+			} `json:"index_templates"`
+		}
+		if err := u.Do("GET", endpoint, nil, &installed); err != nil && !isNotFound(err) {
+			return err
+		}
+		if found = len(installed.IndexTemplates) > 0; found {
+			current = installed.IndexTemplates[0].IndexTemplate.Version
+		}
+	} else {
+		endpoint = "_template/" + o.indexTemplateName
+		var installed map[string]struct {
+			Version *int64 `json:"version"`
+		}
+		if err := u.Do("GET", endpoint, nil, &installed); err != nil && !isNotFound(err) {
+			return err
+		}
+		var t struct {
+			Version *int64 `json:"version"`
+		}
+		if t, found = installed[o.indexTemplateName]; found {
+			current = t.Version
+		}
+	}
+	return u.installIfNewer("index template", o.indexTemplateName, endpoint, template, found, current, wanted)
+}
+
+// installIfNewer PUTs the object if it is missing or if the installed version is older.
+func (u *BackendURL) installIfNewer(kind, name, endpoint string, object map[string]interface{}, found bool, current, wanted *int64) error {
+	if found && (wanted == nil || (current != nil && *current >= *wanted)) {
+		logger.Infof("The %s %q is up to date", kind, name)
+		return nil
+	}
+	body, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+	if err = u.Do("PUT", endpoint, body, nil); err != nil {
+		return fmt.Errorf("Could not install the %s %q: %s", kind, name, err)
+	}
+	if found {
+		logger.Noticef("Updated the %s %q", kind, name)
+	} else {
+		logger.Noticef("Installed the %s %q", kind, name)
+	}
+	return nil
+}
+
+// toComposableTemplate converts a legacy template into a composable one.
+func toComposableTemplate(t map[string]interface{}) map[string]interface{} {
+	if _, ok := t["template"].(map[string]interface{}); ok {
+		return t
+	}
+	inner := map[string]interface{}{}
+	for _, key := range []string{"settings", "mappings", "aliases"} {
+		if v, found := t[key]; found {
+			inner[key] = v
+			delete(t, key)
+		}
+	}
+	if order, found := t["order"]; found {
+		t["priority"] = order
+		delete(t, "order")
+	}
+	t["template"] = inner
+	return t
+}
+
+// toLegacyTemplate converts a composable template into a legacy one.
+func toLegacyTemplate(t map[string]interface{}) map[string]interface{} {
+	inner, ok := t["template"].(map[string]interface{})
+	if !ok {
+		return t
+	}
+	delete(t, "template")
+	for key, v := range inner {
+		t[key] = v
+	}
+	if priority, found := t["priority"]; found {
+		t["order"] = priority
+		delete(t, "priority")
+	}
+	delete(t, "composed_of")
+	delete(t, "data_stream")
+	return t
+}
+
+// setILMPolicy sets a lifecycle setting of a template, e.g. the ILM policy, unless it is already set.
+func setILMPolicy(t map[string]interface{}, name, value string) {
+	settings := jsonObject(t["settings"])
+	if _, found := settings["index.lifecycle."+name]; found {
+		return
+	}
+	if _, found := jsonObject(jsonObject(settings["index"])["lifecycle"])[name]; found {
+		return
+	}
+	settings["index.lifecycle."+name] = value
+	t["settings"] = settings
+}
+
+func readJSONObject(path string) (object map[string]interface{}, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(data, &object); err != nil {
+		err = fmt.Errorf("%s: %s", path, err)
+	} else if object == nil {
+		err = fmt.Errorf("%s: expected a JSON object", path)
+	}
+	return
+}
+
+// jsonObject returns the value as a JSON object, or an empty object.
+func jsonObject(v interface{}) map[string]interface{} {
+	if o, ok := v.(map[string]interface{}); ok {
+		return o
+	}
+	return map[string]interface{}{}
+}
+
+func jsonVersion(v interface{}) *int64 {
+	if f, ok := v.(float64); ok {
+		n := int64(f)
+		return &n
+	}
+	return nil
+}
+
+func isNotFound(err error) bool {
+	e, ok := err.(HTTPError)
+	return ok && e.StatusCode == http.StatusNotFound
+}
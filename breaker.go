@@ -0,0 +1,155 @@
+/*
+bilies-go - Bulk Insert Logs Into ElasticSearch
+Copyright (C) 2016 Adirelle <adirelle@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+/*
+
+Circuit breaker
+
+On top of the backoff of each backend, a circuit breaker protects the whole cluster. After a number of consecutive
+backend errors, whichever the backend, the breaker opens and no request is sent for a while. The next request is
+then used as a probe: the breaker closes if it succeeds and opens again otherwise. Each output has its own breaker.
+
+The following switches control the circuit breaker:
+
+	--breaker-threshold=INT [default: 5]
+		Number of consecutive backend errors that open the breaker (0 to disable).
+
+	--breaker-cooldown=DURATION [default: 30s]
+		How long the breaker stays open before probing the cluster.
+*/
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/spf13/pflag"
+)
+
+// BreakerState is the state of a circuit breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed lets all the requests through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen blocks all the requests.
+	BreakerOpen
+	// BreakerHalfOpen lets a probe request through.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+var (
+	breakerThreshold = 5
+	breakerCooldown  = 30 * time.Second
+)
+
+func init() {
+	pflag.IntVar(&breakerThreshold, "breaker-threshold", breakerThreshold, "Consecutive backend errors that open the circuit breaker (0 to disable)")
+	pflag.DurationVar(&breakerCooldown, "breaker-cooldown", breakerCooldown, "How long the circuit breaker stays open")
+}
+
+// CircuitBreaker stops sending requests to a failing cluster.
+type CircuitBreaker struct {
+	name     string
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+
+	mState    metrics.Gauge
+	mOpened   metrics.Meter
+	mHalfOpen metrics.Meter
+	mClosed   metrics.Meter
+}
+
+// NewCircuitBreaker creates a closed circuit breaker for the named output.
+func NewCircuitBreaker(name string, registry metrics.Registry) *CircuitBreaker {
+	return &CircuitBreaker{
+		name:      name,
+		mState:    metrics.GetOrRegisterGauge("state", registry),
+		mOpened:   metrics.GetOrRegisterMeter("opened", registry),
+		mHalfOpen: metrics.GetOrRegisterMeter("half-opened", registry),
+		mClosed:   metrics.GetOrRegisterMeter("closed", registry),
+	}
+}
+
+// Allow tells whether a request can be sent. If not, it also returns the delay before the next probe.
+func (b *CircuitBreaker) Allow(now time.Time) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != BreakerOpen {
+		return 0, true
+	}
+	if wait := b.openedAt.Add(breakerCooldown).Sub(now); wait > 0 {
+		return wait, false
+	}
+	b.setState(BreakerHalfOpen)
+	return 0, true
+}
+
+// Success records a request answered by the cluster.
+func (b *CircuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	if b.state != BreakerClosed {
+		b.setState(BreakerClosed)
+	}
+}
+
+// Failure records a backend error.
+func (b *CircuitBreaker) Failure(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if breakerThreshold <= 0 {
+		return
+	}
+	b.failures++
+	if b.state == BreakerHalfOpen || (b.state == BreakerClosed && b.failures >= breakerThreshold) {
+		b.openedAt = now
+		b.setState(BreakerOpen)
+	}
+}
+
+func (b *CircuitBreaker) setState(state BreakerState) {
+	b.state = state
+	b.mState.Update(int64(state))
+	switch state {
+	case BreakerOpen:
+		b.mOpened.Mark(1)
+		logger.Noticef("Circuit breaker of %s opened after %d consecutive error(s), pausing for %s", b.name, b.failures, breakerCooldown)
+	case BreakerHalfOpen:
+		b.mHalfOpen.Mark(1)
+		logger.Noticef("Circuit breaker of %s half-opened, probing the cluster", b.name)
+	case BreakerClosed:
+		b.mClosed.Mark(1)
+		logger.Noticef("Circuit breaker of %s closed", b.name)
+	}
+}
@@ -0,0 +1,174 @@
+/*
+bilies-go - Bulk Insert Logs Into ElasticSearch
+Copyright (C) 2016 Adirelle <adirelle@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+/*
+
+ClickHouse
+
+The ClickHouse outputs insert the documents into a table, using the HTTP interface of ClickHouse and the
+JSONEachRow format, e.g. "--output=ch=http://clickhouse:8123/ --output-option=ch:api=clickhouse
+--output-option=ch:sniff=false". The fields of the documents are mapped to the columns of the same name. The
+credentials are sent using basic authentication. The health checks can use the "/ping" endpoint.
+
+ClickHouse reports the errors with a code, in the X-ClickHouse-Exception-Code header. The requests are retried on
+network errors and on the errors which can be temporary, e.g. too many parts, memory limit or timeouts. The batchs
+are split when some documents cannot be parsed or converted. Other errors, like an unknown table, are permanent.
+
+The following switch controls the ClickHouse outputs. It can be set for a given output with --output-option.
+
+	--clickhouse-table=STRING [default: logs]
+		Table of the documents, optionally with the database, e.g. "logs.events".
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+var (
+	clickhouseTable = "logs"
+
+	clickhouseTableRegexp = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*(\\.[A-Za-z_][A-Za-z0-9_]*)?$|^`[^`]+`(\\.`[^`]+`)?$")
+
+	// clickhouseTemporaryCodes are the error codes of ClickHouse worth a retry.
+	clickhouseTemporaryCodes = map[int]bool{
+		159: true, // TIMEOUT_EXCEEDED
+		202: true, // TOO_MANY_SIMULTANEOUS_QUERIES
+		203: true, // NO_FREE_CONNECTION
+		209: true, // SOCKET_TIMEOUT
+		210: true, // NETWORK_ERROR
+		236: true, // ABORTED
+		241: true, // MEMORY_LIMIT_EXCEEDED
+		242: true, // TABLE_IS_READ_ONLY
+		252: true, // TOO_MANY_PARTS
+		319: true, // UNKNOWN_STATUS_OF_INSERT
+		425: true, // SYSTEM_ERROR
+		999: true, // KEEPER_EXCEPTION
+	}
+
+	// clickhouseRejectionCodes are the error codes of ClickHouse caused by some documents.
+	clickhouseRejectionCodes = map[int]bool{
+		6:   true, // CANNOT_PARSE_TEXT
+		26:  true, // CANNOT_PARSE_QUOTED_STRING
+		27:  true, // CANNOT_PARSE_INPUT_ASSERTION_FAILED
+		38:  true, // CANNOT_PARSE_DATE
+		41:  true, // CANNOT_PARSE_DATETIME
+		53:  true, // TYPE_MISMATCH
+		70:  true, // CANNOT_CONVERT_TYPE
+		72:  true, // CANNOT_PARSE_NUMBER
+		117: true, // INCORRECT_DATA
+		349: true, // CANNOT_INSERT_NULL_IN_ORDINARY_COLUMN
+	}
+)
+
+func init() {
+	pflag.StringVar(&clickhouseTable, "clickhouse-table", clickhouseTable, "Table of the ClickHouse outputs")
+
+	AddProtocol("clickhouse", ClickHouseProtocol{})
+}
+
+// ClickHouseProtocol inserts the documents into a ClickHouse table.
+type ClickHouseProtocol struct{}
+
+// ClickHouseError is an error reported by ClickHouse.
+type ClickHouseError struct {
+	Code    int
+	Message string
+}
+
+func (e ClickHouseError) Error() string {
+	return e.Message
+}
+
+func (ClickHouseProtocol) Check(o *Output) error {
+	if o.sniff {
+		return errors.New("ClickHouse does not support sniffing")
+	}
+	if !clickhouseTableRegexp.MatchString(o.clickhouseTable) {
+		return fmt.Errorf("Invalid ClickHouse table %q", o.clickhouseTable)
+	}
+	return nil
+}
+
+func (ClickHouseProtocol) Start(o *Output) {}
+
+func (ClickHouseProtocol) URL(o *Output, u *BackendURL) string {
+	query := url.Values{"query": {fmt.Sprintf("INSERT INTO %s FORMAT JSONEachRow", o.clickhouseTable)}}
+	return u.URL("?" + query.Encode())
+}
+
+// Request writes the documents one per line.
+func (ClickHouseProtocol) Request(o *Output, buf *IndexedBuffer, i, j int) ([]byte, http.Header, error) {
+	var body strings.Builder
+	for _, rec := range buf.Records(i, j) {
+		body.WriteString(rec.Document)
+		body.WriteByte('\n')
+	}
+	return []byte(body.String()), http.Header{"Content-Type": {"application/x-ndjson"}}, nil
+}
+
+func (ClickHouseProtocol) Response(resp *http.Response) (interface{}, error) {
+	msg := readErrorBody(resp)
+	code, err := strconv.Atoi(resp.Header.Get("X-ClickHouse-Exception-Code"))
+	if err != nil && msg == "" {
+		return nil, nil
+	}
+	if msg == "" {
+		msg = fmt.Sprintf("Code: %d", code)
+	}
+	return nil, ClickHouseError{code, msg}
+}
+
+func (ClickHouseProtocol) Report(o *Output, buf *IndexedBuffer, i int, result interface{}) []int {
+	return nil
+}
+
+// IsBackendError retries the temporary errors, or the server errors without a code.
+func (ClickHouseProtocol) IsBackendError(err error) bool {
+	switch e := err.(type) {
+	case HTTPError:
+		if c, ok := e.Cause.(ClickHouseError); ok && c.Code != 0 {
+			return clickhouseTemporaryCodes[c.Code]
+		}
+		return e.Temporary()
+	case ClickHouseError:
+		return clickhouseTemporaryCodes[e.Code]
+	case *url.Error:
+		return true
+	}
+	return false
+}
+
+func (ClickHouseProtocol) IsRejection(err error) bool {
+	e, ok := err.(HTTPError)
+	if !ok {
+		return false
+	}
+	if c, ok := e.Cause.(ClickHouseError); ok && c.Code != 0 {
+		return clickhouseRejectionCodes[c.Code]
+	}
+	return e.StatusCode == http.StatusBadRequest || e.StatusCode == http.StatusRequestEntityTooLarge
+}
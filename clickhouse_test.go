@@ -0,0 +1,117 @@
+/*
+bilies-go - Bulk Insert Logs Into ElasticSearch
+Copyright (C) 2016 Adirelle <adirelle@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func clickhouseResponse(status int, code, body string) *http.Response {
+	resp := &http.Response{
+		StatusCode: status,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+	}
+	if code != "" {
+		resp.Header.Set("X-ClickHouse-Exception-Code", code)
+	}
+	return resp
+}
+
+func TestClickHouseResponse(t *testing.T) {
+	if _, err := (ClickHouseProtocol{}).Response(clickhouseResponse(200, "", "")); err != nil {
+		t.Errorf("expected no error, got %s", err)
+	}
+	for _, c := range []struct {
+		resp     *http.Response
+		expected ClickHouseError
+	}{
+		{clickhouseResponse(500, "252", "Code: 252. DB::Exception: Too many parts\n"), ClickHouseError{252, "Code: 252. DB::Exception: Too many parts"}},
+		{clickhouseResponse(500, "241", ""), ClickHouseError{241, "Code: 241"}},
+		{clickhouseResponse(400, "", "Bad request"), ClickHouseError{0, "Bad request"}},
+	} {
+		_, err := (ClickHouseProtocol{}).Response(c.resp)
+		if e, ok := err.(ClickHouseError); !ok || e != c.expected {
+			t.Errorf("expected %#v, got %#v", c.expected, err)
+		}
+	}
+}
+
+func TestClickHouseErrorClassification(t *testing.T) {
+	httpError := func(status int, code int) HTTPError {
+		e := HTTPError{Status: http.StatusText(status), StatusCode: status}
+		if code >= 0 {
+			e.Cause = ClickHouseError{code, "Code: " + http.StatusText(status)}
+		}
+		return e
+	}
+	for _, c := range []struct {
+		name            string
+		err             error
+		backend, reject bool
+	}{
+		{"too many parts", httpError(500, 252), true, false},
+		{"memory limit", httpError(500, 241), true, false},
+		{"timeout", ClickHouseError{159, "timeout"}, true, false},
+		{"cannot parse", httpError(400, 27), false, true},
+		{"type mismatch", httpError(500, 53), false, true},
+		{"unknown table", httpError(404, 60), false, false},
+		{"syntax error", httpError(500, 62), false, false},
+		{"server error without code", httpError(503, -1), true, false},
+		{"server error with code 0", httpError(502, 0), true, false},
+		{"bad request without code", httpError(400, -1), false, true},
+		{"too large without code", httpError(413, -1), false, true},
+		{"forbidden without code", httpError(403, -1), false, false},
+		{"network error", &url.Error{Op: "Post", URL: "http://clickhouse:8123/", Err: errors.New("connection refused")}, true, false},
+		{"other error", errors.New("other"), false, false},
+	} {
+		if got := (ClickHouseProtocol{}).IsBackendError(c.err); got != c.backend {
+			t.Errorf("%s: expected IsBackendError=%v, got %v", c.name, c.backend, got)
+		}
+		if got := (ClickHouseProtocol{}).IsRejection(c.err); got != c.reject {
+			t.Errorf("%s: expected IsRejection=%v, got %v", c.name, c.reject, got)
+		}
+	}
+}
+
+func TestClickHouseCheck(t *testing.T) {
+	for table, valid := range map[string]bool{
+		"logs":               true,
+		"db.events":          true,
+		"`my logs`":          true,
+		"`my db`.`my logs`":  true,
+		"":                   false,
+		"1logs":              false,
+		"logs; DROP TABLE x": false,
+		"db.events.x":        false,
+	} {
+		o := &Output{Name: "ch", clickhouseTable: table}
+		if err := (ClickHouseProtocol{}).Check(o); (err == nil) != valid {
+			t.Errorf("%q: expected valid=%v, got %v", table, valid, err)
+		}
+	}
+	if err := (ClickHouseProtocol{}).Check(&Output{Name: "ch", clickhouseTable: "logs", sniff: true}); err == nil {
+		t.Error("expected sniffing to be rejected")
+	}
+}
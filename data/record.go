@@ -18,15 +18,53 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 
 package data
 
-import "fmt"
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Priority defines the queue lane of a record.
+type Priority uint8
+
+const (
+	NormalPriority Priority = iota
+	HighPriority
+)
+
+func (p Priority) String() string {
+	if p == HighPriority {
+		return "high"
+	}
+	return "normal"
+}
 
 // Record defines the expected schema of input.
 type Record struct {
 	ID       string
 	Suffix   string
 	Document string
+	QueuedAt int64 // Unix time of enqueuing, in nanoseconds
+
+	Priority   Priority `codec:"-"`
+	ExplicitID bool     `codec:"-"` // Whether the ID comes from the input
+	Key        uint64   `codec:"-"` // Key in the queue, set when the record is read
+	Outputs    []string `codec:"-"` // Outputs the record is routed to, nil for all of them
+}
+
+// Age returns the time spent by the record in the queue, or 0 if unknown.
+func (r Record) Age(now time.Time) time.Duration {
+	if r.QueuedAt == 0 {
+		return 0
+	}
+	return now.Sub(time.Unix(0, r.QueuedAt))
 }
 
 func (r Record) String() string {
 	return fmt.Sprintf("id=%q suffix=%s doc=%s", r.ID, r.Suffix, r.Document)
 }
+
+// InputRecord converts the record back to the input schema.
+func (r Record) InputRecord() InputRecord {
+	return InputRecord{ID: r.ID, Suffix: r.Suffix, Document: json.RawMessage(r.Document)}
+}
@@ -0,0 +1,142 @@
+/*
+bilies-go - Bulk Insert Logs Into ElasticSearch
+Copyright (C) 2016 Adirelle <adirelle@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+/*
+
+Data streams
+
+Instead of daily indices, the documents can be sent to a data stream. In that mode, the "date" of the messages is
+not needed, and --index and --type are ignored. The data stream can be set for a given output with --output-option,
+e.g. "siem:data-stream=logs-siem-default".
+
+Data streams require a "@timestamp" field in the documents. If the document has one, it is validated. Otherwise,
+it is copied from another field of the message, or set to the time the message has been read. When any output
+uses a data stream, the field is added for all the outputs.
+
+The following switches control the data streams:
+
+	--data-stream=STRING [default: none]
+		Name of the data stream, e.g. "logs-app-default".
+
+	--timestamp-field=STRING [default: none]
+		Field to copy into "@timestamp" when missing, e.g. "log.time". The value can be a date, in a format
+		like RFC 3339, or a number of milliseconds since the epoch.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+var (
+	dataStream     string
+	timestampField string
+
+	timestampLayouts = []string{
+		time.RFC3339Nano,
+		"2006-01-02T15:04:05.999999999Z0700",
+		"2006-01-02T15:04:05.999999999",
+		"2006-01-02 15:04:05.999999999Z07:00",
+		"2006-01-02 15:04:05.999999999",
+		"2006-01-02",
+	}
+)
+
+func init() {
+	pflag.StringVar(&dataStream, "data-stream", dataStream, "Name of the data stream")
+	pflag.StringVar(&timestampField, "timestamp-field", timestampField, "Field to copy into @timestamp when missing")
+}
+
+// UsesDataStreams tells whether any output sends the documents to a data stream.
+func UsesDataStreams() bool {
+	for _, o := range outputs {
+		if o.dataStream != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// NeedsDate tells whether any output needs the "date" of the messages.
+func NeedsDate() bool {
+	for _, o := range outputs {
+		if o.UsesDailyIndices() {
+			return true
+		}
+	}
+	return false
+}
+
+// SetTimestamp ensures that the document has a valid "@timestamp" field.
+func SetTimestamp(doc json.RawMessage, fields *Fields, now time.Time) (json.RawMessage, error) {
+	if v, found := fields.Get("log.@timestamp"); found {
+		if _, err := ParseTimestamp(v); err != nil {
+			return nil, fmt.Errorf("Invalid @timestamp: %s", err)
+		}
+		return doc, nil
+	}
+	ts := now
+	if timestampField != "" {
+		if v, found := fields.Get(timestampField); found {
+			var err error
+			if ts, err = ParseTimestamp(v); err != nil {
+				return nil, fmt.Errorf("Invalid %s: %s", timestampField, err)
+			}
+		}
+	}
+
+	// Insert the field at the beginning of the object
+	doc = bytes.TrimLeft(doc, " \t\r\n")
+	if len(doc) == 0 || doc[0] != '{' {
+		return nil, fmt.Errorf("The document is not an object")
+	}
+	field := fmt.Sprintf(`{"@timestamp":%q`, ts.UTC().Format(time.RFC3339Nano))
+	rest := bytes.TrimLeft(doc[1:], " \t\r\n")
+	if len(rest) > 0 && rest[0] != '}' {
+		field += ","
+	}
+	return append([]byte(field), rest...), nil
+}
+
+// ParseTimestamp parses a date, or a number of milliseconds since the epoch.
+func ParseTimestamp(v interface{}) (time.Time, error) {
+	switch t := v.(type) {
+	case string:
+		for _, layout := range timestampLayouts {
+			if ts, err := time.Parse(layout, t); err == nil {
+				return ts, nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("unsupported date format: %q", t)
+	case float64:
+		// Convert the whole milliseconds separately, as float64 cannot hold the nanoseconds since the epoch
+		ms := math.Floor(t)
+		return time.Unix(0, int64(ms)*int64(time.Millisecond)+int64(math.Round((t-ms)*float64(time.Millisecond)))), nil
+	case int64:
+		return time.Unix(0, t*int64(time.Millisecond)), nil
+	case uint64:
+		return time.Unix(0, int64(t)*int64(time.Millisecond)), nil
+	}
+	return time.Time{}, fmt.Errorf("unsupported value: %v", v)
+}
@@ -0,0 +1,93 @@
+/*
+bilies-go - Bulk Insert Logs Into ElasticSearch
+Copyright (C) 2016 Adirelle <adirelle@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	expected := time.Date(2016, 10, 1, 12, 34, 56, 789000000, time.UTC)
+	for _, v := range []interface{}{
+		"2016-10-01T12:34:56.789Z",
+		"2016-10-01T14:34:56.789+02:00",
+		"2016-10-01T14:34:56.789+0200",
+		"2016-10-01T12:34:56.789",
+		"2016-10-01 12:34:56.789Z",
+		"2016-10-01 12:34:56.789",
+		float64(1475325296789),
+		int64(1475325296789),
+		uint64(1475325296789),
+	} {
+		ts, err := ParseTimestamp(v)
+		if err != nil {
+			t.Errorf("%#v: unexpected error: %s", v, err)
+		} else if !ts.Equal(expected) {
+			t.Errorf("%#v: expected %s, got %s", v, expected, ts.UTC())
+		}
+	}
+
+	if ts, err := ParseTimestamp("2016-10-01"); err != nil || !ts.Equal(time.Date(2016, 10, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected the start of the day, got %s, %v", ts, err)
+	}
+
+	if ts, err := ParseTimestamp(1475325296789.5); err != nil || !ts.Equal(expected.Add(500*time.Microsecond)) {
+		t.Errorf("expected the fraction of millisecond to be kept, got %s, %v", ts.UTC(), err)
+	}
+
+	for _, v := range []interface{}{"yesterday", "01/10/2016", "", true, nil, []interface{}{}} {
+		if _, err := ParseTimestamp(v); err == nil {
+			t.Errorf("%#v: expected an error", v)
+		}
+	}
+}
+
+func TestSetTimestamp(t *testing.T) {
+	oldTimestampField := timestampField
+	defer func() { timestampField = oldTimestampField }()
+	timestampField = "log.time"
+	now := time.Date(2016, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	for line, expected := range map[string]string{
+		`{"log":{"@timestamp":"2016-09-30T00:00:00Z","a":1}}`: `{"@timestamp":"2016-09-30T00:00:00Z","a":1}`,
+		`{"log":{"a":1}}`:                        `{"@timestamp":"2016-10-01T12:00:00Z","a":1}`,
+		`{"log":{}}`:                             `{"@timestamp":"2016-10-01T12:00:00Z"}`,
+		`{"log":{"time":1475280000000}}`:         `{"@timestamp":"2016-10-01T00:00:00Z","time":1475280000000}`,
+		`{"log":{"time":"2016-10-01 02:00:00"}}`: `{"@timestamp":"2016-10-01T02:00:00Z","time":"2016-10-01 02:00:00"}`,
+	} {
+		doc := generateDocument(line)
+		got, err := SetTimestamp(doc, NewFields([]byte(line)), now)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", line, err)
+		} else if string(got) != expected {
+			t.Errorf("%s: expected %s, got %s", line, expected, got)
+		}
+	}
+
+	for _, line := range []string{
+		`{"log":{"@timestamp":"yesterday"}}`,
+		`{"log":{"time":"yesterday"}}`,
+		`{"log":[1,2]}`,
+	} {
+		if _, err := SetTimestamp(generateDocument(line), NewFields([]byte(line)), now); err == nil {
+			t.Errorf("%s: expected an error", line)
+		}
+	}
+}
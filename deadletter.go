@@ -0,0 +1,88 @@
+/*
+bilies-go - Bulk Insert Logs Into ElasticSearch
+Copyright (C) 2016 Adirelle <adirelle@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+/*
+
+Dead letters
+
+Records that cannot be delivered (e.g. because they are too old) are dropped. They can be kept in a file instead,
+using the input format, so they can be fed back to bilies-go later.
+
+The following switch controls dead letters:
+
+	--dead-letter-file=STRING [default: none]
+		Append undeliverable records to the file.
+*/
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/spf13/pflag"
+
+	"github.com/Adirelle/bilies-go/data"
+)
+
+var (
+	deadLetterFile  string
+	deadLetterMutex sync.Mutex
+
+	mDeadLetter        = metrics.NewPrefixedChildRegistry(mRoot, "deadletter.")
+	mDeadLetterRecords = metrics.GetOrRegisterMeter("records", mDeadLetter)
+	mDeadLetterErrors  = metrics.GetOrRegisterMeter("errors", mDeadLetter)
+)
+
+func init() {
+	pflag.StringVar(&deadLetterFile, "dead-letter-file", deadLetterFile, "Append undeliverable records to that file")
+}
+
+// DeadLetter discards undeliverable records, writing them into the dead letter file, if any.
+func DeadLetter(reason string, recs ...data.Record) {
+	if len(recs) == 0 {
+		return
+	}
+	mDeadLetterRecords.Mark(int64(len(recs)))
+	if deadLetterFile == "" {
+		logger.Warningf("Dropped %d record(s): %s", len(recs), reason)
+		return
+	}
+
+	deadLetterMutex.Lock()
+	defer deadLetterMutex.Unlock()
+
+	f, err := os.OpenFile(deadLetterFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0660)
+	if err != nil {
+		mDeadLetterErrors.Mark(1)
+		logger.Errorf("Cannot open dead letter file %q, dropped %d record(s): %s", deadLetterFile, len(recs), err)
+		return
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	enc.SetEscapeHTML(false)
+	for _, rec := range recs {
+		if err := enc.Encode(rec.InputRecord()); err != nil {
+			mDeadLetterErrors.Mark(1)
+			logger.Errorf("Could not write record %q to dead letter file: %s", rec.ID, err)
+		}
+	}
+	logger.Warningf("Moved %d record(s) to %q: %s", len(recs), deadLetterFile, reason)
+}
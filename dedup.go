@@ -0,0 +1,165 @@
+/*
+bilies-go - Bulk Insert Logs Into ElasticSearch
+Copyright (C) 2016 Adirelle <adirelle@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+/*
+
+Duplicate suppression
+
+Records with an explicit "id" can be checked against the IDs of the previously enqueued records.
+Duplicates are dropped before being enqueued. The window of known IDs is kept in the queue database and is
+bounded by time, by number of IDs, or both.
+
+The following switches control duplicate suppression:
+
+	--dedup-window=DURATION [default: 0]
+		How long the IDs are remembered (0 for no time limit).
+
+	--dedup-size=INT [default: 0]
+		How many IDs are remembered (0 for no count limit).
+
+Duplicate suppression is disabled unless one of them is set. It is also disabled by the replay command, so the
+replayed records are not dropped.
+*/
+package main
+
+import (
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/spf13/pflag"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+var (
+	dedupWindow time.Duration
+	dedupSize   int
+
+	mQueueDuplicates = metrics.GetOrRegisterMeter("duplicates.records", mQueue)
+	mQueueDedupIDs   = metrics.GetOrRegisterGauge("dedup.ids", mQueue)
+
+	// Prefixes of the keys of the ID index, by ID and by time.
+	dedupIDPrefix   = append(append([]byte{}, metaPrefix...), 'd')
+	dedupTimePrefix = append(append([]byte{}, metaPrefix...), 't')
+)
+
+func init() {
+	pflag.DurationVar(&dedupWindow, "dedup-window", dedupWindow, "How long the record IDs are remembered for duplicate suppression")
+	pflag.IntVar(&dedupSize, "dedup-size", dedupSize, "How many record IDs are remembered for duplicate suppression")
+}
+
+// DedupIndex remembers the IDs of the last enqueued records.
+//
+// It holds two sets of keys: the ID keys, which values are the enqueuing times, and the time keys, which are
+// ordered by time and used for eviction.
+type DedupIndex struct {
+	db    *leveldb.DB
+	count int
+	batch map[string]bool
+}
+
+// NewDedupIndex returns an index, or nil if duplicate suppression is disabled.
+func NewDedupIndex(db *leveldb.DB) *DedupIndex {
+	if dedupWindow <= 0 && dedupSize <= 0 {
+		return nil
+	}
+	d := &DedupIndex{db: db, batch: make(map[string]bool)}
+	d.recount()
+	logger.Infof("Duplicate suppression enabled, window=%s, size=%d, known IDs=%d", dedupWindow, dedupSize, d.count)
+	return d
+}
+
+// IsDuplicate checks whether the ID is known, either in the database or in the current batch.
+func (d *DedupIndex) IsDuplicate(id string, now time.Time) bool {
+	if d.batch[id] {
+		return true
+	}
+	v, err := d.db.Get(dedupIDKey(id), nil)
+	if err != nil {
+		return false
+	}
+	return dedupWindow <= 0 || now.Sub(time.Unix(0, int64(FromBytes(v)))) < dedupWindow
+}
+
+// Add adds the ID to the index, as part of the batch.
+func (d *DedupIndex) Add(b *leveldb.Batch, id string, now time.Time) {
+	if v, err := d.db.Get(dedupIDKey(id), nil); err == nil {
+		b.Delete(dedupTimeKey(FromBytes(v), id))
+	} else {
+		d.count++
+	}
+	ts := DbKey(now.UnixNano())
+	b.Put(dedupIDKey(id), ts.Bytes())
+	b.Put(dedupTimeKey(ts, id), nil)
+	d.batch[id] = true
+}
+
+// Evict removes the oldest IDs from the index, as part of the batch.
+func (d *DedupIndex) Evict(b *leveldb.Batch, now time.Time) {
+	excess := 0
+	if dedupSize > 0 && d.count > dedupSize {
+		excess = d.count - dedupSize
+	}
+	limit := dedupTimeKey(DbKey(now.Add(-dedupWindow).UnixNano()), "")
+	iter := d.db.NewIterator(util.BytesPrefix(dedupTimePrefix), nil)
+	defer iter.Release()
+	for iter.Next() {
+		key := iter.Key()
+		if excess <= 0 && (dedupWindow <= 0 || string(key) >= string(limit)) {
+			break
+		}
+		id := string(key[len(dedupTimePrefix)+8:])
+		if d.batch[id] {
+			// Already replaced by Add
+			continue
+		}
+		b.Delete(dedupIDKey(id))
+		b.Delete(append([]byte{}, key...))
+		d.count--
+		excess--
+	}
+}
+
+// Commit ends the current batch.
+func (d *DedupIndex) Commit(success bool) {
+	d.batch = make(map[string]bool)
+	if !success {
+		d.recount()
+	}
+	mQueueDedupIDs.Update(int64(d.count))
+}
+
+func (d *DedupIndex) recount() {
+	d.count = 0
+	iter := d.db.NewIterator(util.BytesPrefix(dedupTimePrefix), nil)
+	for iter.Next() {
+		d.count++
+	}
+	iter.Release()
+	mQueueDedupIDs.Update(int64(d.count))
+}
+
+func dedupIDKey(id string) []byte {
+	return append(append([]byte{}, dedupIDPrefix...), id...)
+}
+
+func dedupTimeKey(ts DbKey, id string) []byte {
+	k := append(append([]byte{}, dedupTimePrefix...), make([]byte, 8)...)
+	converter.PutUint64(k[len(dedupTimePrefix):], uint64(ts))
+	return append(k, id...)
+}
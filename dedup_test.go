@@ -0,0 +1,161 @@
+/*
+bilies-go - Bulk Insert Logs Into ElasticSearch
+Copyright (C) 2016 Adirelle <adirelle@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Adirelle/bilies-go/data"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// withDedup sets the duplicate suppression limits and returns a function that restores them.
+func withDedup(window time.Duration, size int) func() {
+	oldWindow, oldSize := dedupWindow, dedupSize
+	dedupWindow, dedupSize = window, size
+	return func() {
+		dedupWindow, dedupSize = oldWindow, oldSize
+	}
+}
+
+// newTestDedupIndex opens a database in a temporary directory and returns an index on it.
+func newTestDedupIndex(t *testing.T) (*DedupIndex, *leveldb.DB) {
+	db, err := leveldb.OpenFile(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	d := NewDedupIndex(db)
+	if d == nil {
+		t.Fatal("expected duplicate suppression to be enabled")
+	}
+	return d, db
+}
+
+// addIDs adds the IDs to the index and evicts the oldest ones, like the queue writer does.
+func addIDs(t *testing.T, d *DedupIndex, db *leveldb.DB, now time.Time, ids ...string) {
+	var b leveldb.Batch
+	for _, id := range ids {
+		d.Add(&b, id, now)
+	}
+	d.Evict(&b, now)
+	err := db.Write(&b, nil)
+	d.Commit(err == nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueueSuppressesDuplicates(t *testing.T) {
+	// The queue is closed by a cleanup function, which must run before this one
+	t.Cleanup(withDedup(0, 100))
+
+	q := openTestQueue(t, t.TempDir(), defaultOutputName)
+	before := mQueueDuplicates.Count()
+	recs := []data.Record{
+		{ID: "a", ExplicitID: true, Suffix: "2016.10.01", Document: `{}`},
+		{ID: "b", ExplicitID: true, Suffix: "2016.10.01", Document: `{}`},
+		{ID: "a", ExplicitID: true, Suffix: "2016.10.01", Document: `{}`},
+		// Generated IDs are not checked
+		{ID: "a", Suffix: "2016.10.01", Document: `{}`},
+	}
+	q.WriteC <- recs
+	q.WriteC <- []data.Record{{ID: "b", ExplicitID: true, Suffix: "2016.10.01", Document: `{}`}}
+	q.WriteC <- nil
+
+	if n := countRecords(q); n != 3 {
+		t.Errorf("expected 3 queued records, got %d", n)
+	}
+	if n := mQueueDuplicates.Count() - before; n != 2 {
+		t.Errorf("expected 2 duplicates to be counted, got %d", n)
+	}
+}
+
+func TestQueueWithoutDuplicateSuppression(t *testing.T) {
+	// The queue is closed by a cleanup function, which must run before this one
+	t.Cleanup(withDedup(0, 100))
+
+	q, err := OpenQueue(t.TempDir(), []string{defaultOutputName}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(q.Close)
+	rec := data.Record{ID: "a", ExplicitID: true, Suffix: "2016.10.01", Document: `{}`}
+	q.WriteC <- []data.Record{rec, rec}
+	q.WriteC <- []data.Record{rec}
+	q.WriteC <- nil
+
+	if n := countRecords(q); n != 3 {
+		t.Errorf("expected the 3 records to be queued, got %d", n)
+	}
+}
+
+func TestDedupEvictsByCount(t *testing.T) {
+	defer withDedup(0, 2)()
+
+	d, db := newTestDedupIndex(t)
+	now := time.Now()
+	addIDs(t, d, db, now, "a")
+	addIDs(t, d, db, now.Add(time.Second), "b")
+	addIDs(t, d, db, now.Add(2*time.Second), "c")
+
+	now = now.Add(3 * time.Second)
+	if d.count != 2 {
+		t.Errorf("expected 2 known IDs, got %d", d.count)
+	}
+	if d.IsDuplicate("a", now) {
+		t.Error("expected the oldest ID to be released")
+	}
+	for _, id := range []string{"b", "c"} {
+		if !d.IsDuplicate(id, now) {
+			t.Errorf("expected %q to be known", id)
+		}
+	}
+}
+
+func TestDedupEvictsByAge(t *testing.T) {
+	defer withDedup(time.Minute, 0)()
+
+	d, db := newTestDedupIndex(t)
+	now := time.Now()
+	addIDs(t, d, db, now, "a", "b")
+	addIDs(t, d, db, now.Add(30*time.Second), "c")
+
+	if !d.IsDuplicate("a", now.Add(59*time.Second)) {
+		t.Error("expected \"a\" to be known within the window")
+	}
+
+	now = now.Add(70 * time.Second)
+	addIDs(t, d, db, now)
+	if d.count != 1 {
+		t.Errorf("expected 1 known ID, got %d", d.count)
+	}
+	for _, id := range []string{"a", "b"} {
+		if d.IsDuplicate(id, now) {
+			t.Errorf("expected %q to be released", id)
+		}
+		if found, _ := db.Has(dedupIDKey(id), nil); found {
+			t.Errorf("expected %q to be removed from the database", id)
+		}
+	}
+	if !d.IsDuplicate("c", now) {
+		t.Error("expected \"c\" to be known")
+	}
+}
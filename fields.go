@@ -0,0 +1,81 @@
+/*
+bilies-go - Bulk Insert Logs Into ElasticSearch
+Copyright (C) 2016 Adirelle <adirelle@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/ugorji/go/codec"
+)
+
+var fieldsCodecHandle = &codec.JsonHandle{}
+
+func init() {
+	fieldsCodecHandle.MapType = reflect.TypeOf(map[string]interface{}(nil))
+}
+
+// Fields gives access to the fields of an input message, which is only decoded when needed.
+type Fields struct {
+	raw     []byte
+	decoded map[string]interface{}
+	err     error
+}
+
+// NewFields creates a Fields for the given JSON message.
+func NewFields(raw []byte) *Fields {
+	return &Fields{raw: raw}
+}
+
+// Get returns the value of the field designated by a dot-separated path, e.g. "log.severity".
+func (f *Fields) Get(path string) (v interface{}, found bool) {
+	if f.decoded == nil && f.err == nil {
+		f.err = codec.NewDecoderBytes(f.raw, fieldsCodecHandle).Decode(&f.decoded)
+		if f.err != nil {
+			logger.Errorf("Could not decode message: %s", f.err)
+		}
+	}
+	if f.err != nil {
+		return
+	}
+	v = f.decoded
+	for _, name := range strings.Split(path, ".") {
+		m, isMap := v.(map[string]interface{})
+		if !isMap {
+			return nil, false
+		}
+		if v, found = m[name]; !found {
+			return
+		}
+	}
+	return
+}
+
+// GetString returns the value of field as a string.
+func (f *Fields) GetString(path string) (s string, found bool) {
+	var v interface{}
+	if v, found = f.Get(path); !found || v == nil {
+		return "", false
+	}
+	if s, isString := v.(string); isString {
+		return s, true
+	}
+	return fmt.Sprint(v), true
+}
@@ -21,27 +21,39 @@ package main
 import (
 	"bytes"
 	"fmt"
+
+	"github.com/Adirelle/bilies-go/data"
 )
 
 // IndexedBuffer is a bytes.Buffer that also holds an index and a map to identify records.
 type IndexedBuffer struct {
 	bytes.Buffer
-	index []int
-	keys  map[string]int
+	ID      string
+	retries int
+	index   []int
+	keys    map[string]int
+	records []data.Record
 }
 
 func MakeIndexedBuffer(n int) IndexedBuffer {
+	return MakeSizedIndexedBuffer(n, n*1024)
+}
+
+// MakeSizedIndexedBuffer creates a buffer for n records of size bytes.
+func MakeSizedIndexedBuffer(n int, size int) IndexedBuffer {
 	return IndexedBuffer{
-		Buffer: *bytes.NewBuffer(make([]byte, 0, n*1024)),
-		index:  make([]int, 0, n),
-		keys:   make(map[string]int, n),
+		Buffer:  *bytes.NewBuffer(make([]byte, 0, size)),
+		index:   make([]int, 0, n),
+		keys:    make(map[string]int, n),
+		records: make([]data.Record, 0, n),
 	}
 }
 
 // Mark marks a record in the buffer.
-func (b *IndexedBuffer) Mark(key string) {
+func (b *IndexedBuffer) Mark(rec data.Record) {
 	b.index = append(b.index, b.Len())
-	b.keys[key] = len(b.index)
+	b.keys[rec.ID] = len(b.index)
+	b.records = append(b.records, rec)
 }
 
 // Count returns the number of marked records.
@@ -69,3 +81,49 @@ func (b *IndexedBuffer) GetByKey(key string) ([]byte, error) {
 func (b *IndexedBuffer) Slice(i int, j int) []byte {
 	return b.Bytes()[b.PosOf(i):b.PosOf(j)]
 }
+
+// QueueKeys returns the queue keys of the records between i, included, and j, excluded.
+func (b *IndexedBuffer) QueueKeys(i int, j int) []DbKey {
+	keys := make([]DbKey, j-i)
+	for k, rec := range b.records[i:j] {
+		keys[k] = DbKey(rec.Key)
+	}
+	return keys
+}
+
+// Records returns the records between i, included, and j, excluded.
+func (b *IndexedBuffer) Records(i int, j int) []data.Record {
+	return b.records[i:j]
+}
+
+// QueueKeysExcept returns the queue keys of the records between i, included, and j, excluded, except the ones at the
+// given positions.
+func (b *IndexedBuffer) QueueKeysExcept(i int, j int, excluded []int) []DbKey {
+	skip := make(map[int]bool, len(excluded))
+	for _, k := range excluded {
+		skip[k] = true
+	}
+	keys := make([]DbKey, 0, j-i)
+	for k := i; k < j; k++ {
+		if !skip[k] {
+			keys = append(keys, DbKey(b.records[k].Key))
+		}
+	}
+	return keys
+}
+
+// Subset returns a new buffer holding the records at the given positions, to send them again.
+func (b *IndexedBuffer) Subset(positions []int) IndexedBuffer {
+	size := 0
+	for _, k := range positions {
+		size += b.PosOf(k+1) - b.PosOf(k)
+	}
+	s := MakeSizedIndexedBuffer(len(positions), size)
+	s.ID = b.ID
+	s.retries = b.retries + 1
+	for _, k := range positions {
+		s.Write(b.Slice(k, k+1))
+		s.Mark(b.records[k])
+	}
+	return s
+}
@@ -0,0 +1,203 @@
+/*
+bilies-go - Bulk Insert Logs Into ElasticSearch
+Copyright (C) 2016 Adirelle <adirelle@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+/*
+
+Loki
+
+The Loki outputs push the documents to the "/loki/api/v1/push" endpoint of Grafana Loki, e.g.
+"--output=loki=http://loki:3100/ --output-option=loki:api=loki --output-option=loki:sniff=false". Each document
+is a log line, labelled from fields of the message. Its time is read from the "@timestamp" field of the document,
+or from --timestamp-field, and defaults to the time of the request. The tenant can be set using --header, e.g.
+"X-Scope-OrgID: foo". The health checks can use the "/ready" endpoint, e.g. "loki:health-check-path=ready".
+
+The requests are retried on network, 429 and 5xx errors, and the batchs are split on 400 and 413 errors, e.g. when
+Loki rejects entries which are too old.
+
+The following switches control the Loki outputs. They can be set for a given output with --output-option.
+
+	--loki-labels=NAME=FIELD,... [default: none]
+		Labels of the log lines, read from fields of the messages, e.g. "level=log.level,app=log.app". The label
+		is omitted when the message has no such field. Loki expects a small number of distinct values.
+
+	--loki-job=STRING [default: bilies]
+		Value of the "job" label of all the log lines. Use an empty string to omit it.
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+var (
+	lokiLabels []string
+	lokiJob    = "bilies"
+
+	lokiLabelRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+func init() {
+	pflag.StringSliceVar(&lokiLabels, "loki-labels", lokiLabels, "Labels of the Loki log lines, as NAME=FIELD")
+	pflag.StringVar(&lokiJob, "loki-job", lokiJob, "Value of the job label of the Loki log lines")
+
+	AddProtocol("loki", LokiProtocol{})
+}
+
+// LokiProtocol pushes the documents to Grafana Loki.
+type LokiProtocol struct{}
+
+// lokiStream is a set of log lines sharing the same labels.
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+// Check parses the labels.
+func (LokiProtocol) Check(o *Output) error {
+	if o.sniff {
+		return errors.New("Loki does not support sniffing")
+	}
+	o.lokiLabelFields = make(map[string]string, len(o.lokiLabels))
+	for _, raw := range o.lokiLabels {
+		parts := strings.SplitN(raw, "=", 2)
+		if len(parts) != 2 || !lokiLabelRegexp.MatchString(strings.TrimSpace(parts[0])) || strings.TrimSpace(parts[1]) == "" {
+			return fmt.Errorf("Invalid Loki label %q, expected NAME=FIELD", raw)
+		}
+		o.lokiLabelFields[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	if o.lokiJob == "" && len(o.lokiLabelFields) == 0 {
+		return errors.New("Loki needs at least one label, use --loki-labels or --loki-job")
+	}
+	return nil
+}
+
+func (LokiProtocol) Start(o *Output) {}
+
+func (LokiProtocol) URL(o *Output, u *BackendURL) string {
+	return u.URL("loki/api/v1/push")
+}
+
+// Request groups the documents into streams, by labels.
+func (LokiProtocol) Request(o *Output, buf *IndexedBuffer, i, j int) ([]byte, http.Header, error) {
+	var (
+		streams []*lokiStream
+		byKey   = map[string]*lokiStream{}
+		now     = time.Now()
+	)
+	for _, rec := range buf.Records(i, j) {
+		raw, err := json.Marshal(rec.InputRecord())
+		if err != nil {
+			return nil, nil, err
+		}
+		fields := NewFields(raw)
+
+		labels := map[string]string{}
+		if o.lokiJob != "" {
+			labels["job"] = o.lokiJob
+		}
+		for name, field := range o.lokiLabelFields {
+			if v, found := fields.GetString(field); found {
+				labels[name] = v
+			}
+		}
+		key := lokiStreamKey(labels)
+		s, found := byKey[key]
+		if !found {
+			s = &lokiStream{Stream: labels}
+			byKey[key] = s
+			streams = append(streams, s)
+		}
+
+		ts := now
+		field := "log.@timestamp"
+		if _, found := fields.Get(field); !found && timestampField != "" {
+			field = timestampField
+		}
+		if v, found := fields.Get(field); found {
+			ts, err = ParseTimestamp(v)
+		}
+		if err != nil {
+			logger.Warningf("Invalid timestamp of %s, using the current time: %s", rec.ID, err)
+			ts = now
+		}
+		s.Values = append(s.Values, [2]string{strconv.FormatInt(ts.UnixNano(), 10), rec.Document})
+	}
+	// Loki expects the log lines of a stream in chronological order
+	for _, s := range streams {
+		sort.SliceStable(s.Values, func(a, b int) bool {
+			ta, _ := strconv.ParseInt(s.Values[a][0], 10, 64)
+			tb, _ := strconv.ParseInt(s.Values[b][0], 10, 64)
+			return ta < tb
+		})
+	}
+	body, err := json.Marshal(struct {
+		Streams []*lokiStream `json:"streams"`
+	}{streams})
+	return body, http.Header{"Content-Type": {"application/json"}}, err
+}
+
+func (LokiProtocol) Response(resp *http.Response) (interface{}, error) {
+	if msg := readErrorBody(resp); msg != "" {
+		return nil, errors.New(msg)
+	}
+	return nil, nil
+}
+
+func (LokiProtocol) Report(o *Output, buf *IndexedBuffer, i int, result interface{}) []int {
+	return nil
+}
+
+func (LokiProtocol) IsBackendError(err error) bool {
+	switch e := err.(type) {
+	case HTTPError:
+		return e.Temporary()
+	case *url.Error:
+		return true
+	}
+	return false
+}
+
+func (LokiProtocol) IsRejection(err error) bool {
+	e, ok := err.(HTTPError)
+	return ok && (e.StatusCode == http.StatusBadRequest || e.StatusCode == http.StatusRequestEntityTooLarge)
+}
+
+// lokiStreamKey returns a string identifying a set of labels.
+func lokiStreamKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s=%q,", name, labels[name])
+	}
+	return b.String()
+}
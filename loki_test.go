@@ -0,0 +1,114 @@
+/*
+bilies-go - Bulk Insert Logs Into ElasticSearch
+Copyright (C) 2016 Adirelle <adirelle@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/Adirelle/bilies-go/data"
+)
+
+func TestLokiStreamKey(t *testing.T) {
+	a := lokiStreamKey(map[string]string{"job": "bilies", "level": "info"})
+	if b := lokiStreamKey(map[string]string{"level": "info", "job": "bilies"}); b != a {
+		t.Errorf("same labels, expected %q, got %q", a, b)
+	}
+	for _, labels := range []map[string]string{
+		{"job": "bilies"},
+		{"job": "bilies", "level": "warning"},
+		{"job": "bilies", "level": "info", "app": "web"},
+		{"job": "bilies", "level": `info",job="bilies`},
+		{},
+	} {
+		if b := lokiStreamKey(labels); b == a {
+			t.Errorf("%v: different labels, both got %q", labels, a)
+		}
+	}
+}
+
+func TestLokiCheck(t *testing.T) {
+	for _, c := range []struct {
+		labels []string
+		job    string
+		valid  bool
+	}{
+		{nil, "bilies", true},
+		{[]string{"level=log.level", " app = log.app "}, "", true},
+		{nil, "", false},
+		{[]string{"level"}, "bilies", false},
+		{[]string{"level="}, "bilies", false},
+		{[]string{"1level=log.level"}, "bilies", false},
+	} {
+		o := &Output{Name: "loki", lokiLabels: c.labels, lokiJob: c.job}
+		if err := (LokiProtocol{}).Check(o); (err == nil) != c.valid {
+			t.Errorf("%v, job %q: expected valid=%v, got %v", c.labels, c.job, c.valid, err)
+		}
+	}
+}
+
+func TestLokiRequest(t *testing.T) {
+	o := &Output{Name: "loki", lokiLabels: []string{"level=log.level"}, lokiJob: "bilies"}
+	if err := (LokiProtocol{}).Check(o); err != nil {
+		t.Fatal(err)
+	}
+	buf := MakeIndexedBuffer(4)
+	for i, doc := range []string{
+		`{"@timestamp":"2016-10-01T12:00:02Z","level":"info","msg":"c"}`,
+		`{"@timestamp":"2016-10-01T12:00:01Z","level":"warning","msg":"w"}`,
+		`{"@timestamp":"2016-10-01T12:00:00Z","level":"info","msg":"b"}`,
+		`{"@timestamp":"2016-10-01T11:59:59Z","level":"info","msg":"a"}`,
+	} {
+		buf.Mark(data.Record{ID: string(rune('a' + i)), Suffix: "2016.10.01", Document: doc})
+	}
+
+	body, _, err := (LokiProtocol{}).Request(o, &buf, 0, buf.Count())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var push struct {
+		Streams []lokiStream `json:"streams"`
+	}
+	if err := json.Unmarshal(body, &push); err != nil {
+		t.Fatal(err)
+	}
+	if len(push.Streams) != 2 {
+		t.Fatalf("expected 2 streams, got %s", body)
+	}
+	info := push.Streams[0]
+	if info.Stream["job"] != "bilies" || info.Stream["level"] != "info" {
+		t.Errorf("unexpected labels %v", info.Stream)
+	}
+	expected := [][2]string{
+		{"1475323199000000000", `{"@timestamp":"2016-10-01T11:59:59Z","level":"info","msg":"a"}`},
+		{"1475323200000000000", `{"@timestamp":"2016-10-01T12:00:00Z","level":"info","msg":"b"}`},
+		{"1475323202000000000", `{"@timestamp":"2016-10-01T12:00:02Z","level":"info","msg":"c"}`},
+	}
+	if len(info.Values) != len(expected) {
+		t.Fatalf("expected %d values, got %v", len(expected), info.Values)
+	}
+	for k := range expected {
+		if info.Values[k] != expected[k] {
+			t.Errorf("value #%d: expected %v, got %v", k, expected[k], info.Values[k])
+		}
+	}
+	if warning := push.Streams[1]; warning.Stream["level"] != "warning" || len(warning.Values) != 1 {
+		t.Errorf("unexpected stream %v", warning)
+	}
+}
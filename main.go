@@ -62,17 +62,31 @@ func init() {
 }
 
 func main() {
+	ParseCommand()
 	pflag.Parse()
 
 	SetupLogging()
 	logger.Noticef("===== bilies-go starting, PID %d =====", os.Getpid())
 
 	var err error
-	queue, err = OpenQueue(queueDir)
+	if outputs, err = ParseOutputs(); err != nil {
+		logger.Fatalf("Invalid outputs: %s", err)
+	}
+	if err = SetupRoutes(); err != nil {
+		logger.Fatalf("Invalid routes: %s", err)
+	}
+	if err = SetupReplay(); err != nil {
+		logger.Fatalf("Invalid replay: %s", err)
+	}
+	// The replayed records are expected to have been sent already, so they are not checked for duplicates
+	queue, err = OpenQueue(queueDir, OutputNames(), !replayMode)
 	if err != nil {
 		logger.Fatalf("Cannot open the message queue in %q: %s", queueDir, err)
 	}
 	defer queue.Close()
+	for _, o := range outputs {
+		o.cursor = queue.Cursor(o.Name)
+	}
 
 	if pidFile != "" {
 		SetupPidFile()
@@ -0,0 +1,340 @@
+/*
+bilies-go - Bulk Insert Logs Into ElasticSearch
+Copyright (C) 2016 Adirelle <adirelle@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+/*
+
+Outputs
+
+By default, the messages are sent to a single cluster, set by --url or --host. They can also be sent to several
+clusters, e.g. a production cluster and a SIEM, or to other log stores, see the API switches. Each output reads the queue at its own pace, with its own batchs,
+backend pool and circuit breaker, so a slow output does not hold the others back. The messages are removed from
+the queue once every output has sent them. See also the routing switches.
+
+The other switches apply to all the outputs, but some of them can be overridden for a given output:
+
+	--output=NAME=URL[,URL...] [default: none]
+		Name and URLs of an output, e.g. "siem=https://siem1:9200/,https://siem2:9200/". The name can only contain
+		letters, digits, "-" and "_". The URL can also be the directory of a file output, e.g.
+		"archive=file:///var/lib/bilies/archive". This switch can be used multiple times. If used, --url, --host,
+		--protocol and --port are ignored.
+
+	--output-option=NAME:SWITCH=VALUE [default: none]
+		Set a switch for the named output only, e.g. "siem:index=audit". The following switches can be set
+		this way: --index, --type, --batch-size, --flush-delay, --user, --passwd, --passwd-file, --api-key,
+		--api-key-file, --bearer-token, --bearer-token-file, --index-template, --index-template-name,
+		--ilm-policy, --ilm-policy-name, --health-check-path, --sniff, --data-stream, --write-alias, --api,
+		--aws-sigv4, --aws-region, --aws-service, the Loki and ClickHouse switches and the file output switches. This switch can be used multiple times.
+*/
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/spf13/pflag"
+)
+
+const defaultOutputName = "default"
+
+var (
+	rawOutputs       []string
+	rawOutputOptions []string
+
+	outputs []*Output
+
+	outputNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+	mOutputs = metrics.NewPrefixedChildRegistry(mRoot, "outputs.")
+)
+
+func init() {
+	pflag.StringArrayVar(&rawOutputs, "output", rawOutputs, "Output, as NAME=URL[,URL...]")
+	pflag.StringArrayVar(&rawOutputOptions, "output-option", rawOutputOptions, "Switch of an output, as NAME:SWITCH=VALUE")
+
+	AddMainTask("Outputs", RunOutputs)
+}
+
+// Output sends the messages to a cluster, or another log store.
+type Output struct {
+	Name string
+	URLs []string
+	dir  string
+
+	indexPrefix       string
+	docType           string
+	batchSize         int
+	flushDelay        time.Duration
+	indexTemplateFile string
+	indexTemplateName string
+	ilmPolicyFile     string
+	ilmPolicyName     string
+	credentials       *Credentials
+	healthCheckPath   string
+	sniff             bool
+	dataStream        string
+	writeAlias        string
+	awsSigV4          bool
+	awsRegion         string
+	awsService        string
+	signer            *AWSSigner
+
+	api             string
+	protocol        Protocol
+	lokiLabels      []string
+	lokiLabelFields map[string]string
+	lokiJob         string
+	clickhouseTable string
+
+	fileFormat         string
+	fileRotateSize     int64
+	fileRotateInterval time.Duration
+	fileGzip           bool
+
+	cursor  *Cursor
+	batchs  chan IndexedBuffer
+	pool    *BackendURLPool
+	breaker *CircuitBreaker
+
+	batchLimit   int64
+	docsLimiter  *TokenBucket
+	bytesLimiter *TokenBucket
+
+	// rolloverDocs counts the documents indexed since the last rollover request
+	rolloverDocs    int64
+	rolloverTrigger chan bool
+
+	metrics     metrics.Registry
+	mBatchLimit metrics.Gauge
+}
+
+// NewOutput creates an output, with the settings of the command line.
+func NewOutput(name string, urls []string) *Output {
+	registry := metrics.NewPrefixedChildRegistry(mOutputs, name+".")
+	return &Output{
+		Name:              name,
+		URLs:              urls,
+		indexPrefix:       indexPrefix,
+		docType:           docType,
+		batchSize:         batchSize,
+		flushDelay:        flushDelay,
+		indexTemplateFile: indexTemplateFile,
+		indexTemplateName: indexTemplateName,
+		ilmPolicyFile:     ilmPolicyFile,
+		ilmPolicyName:     ilmPolicyName,
+		credentials:       credentials,
+		healthCheckPath:   healthCheckPath,
+		sniff:             sniff,
+		dataStream:        dataStream,
+		writeAlias:        writeAlias,
+		awsSigV4:          awsSigV4,
+		awsRegion:         awsRegion,
+		awsService:        awsService,
+
+		api:             api,
+		lokiLabels:      lokiLabels,
+		lokiJob:         lokiJob,
+		clickhouseTable: clickhouseTable,
+
+		fileFormat:         fileFormat,
+		fileRotateSize:     fileRotateSize,
+		fileRotateInterval: fileRotateInterval,
+		fileGzip:           fileGzip,
+
+		batchs:          make(chan IndexedBuffer),
+		breaker:         NewCircuitBreaker(name, metrics.NewPrefixedChildRegistry(registry, "breaker.")),
+		docsLimiter:     &TokenBucket{},
+		bytesLimiter:    &TokenBucket{},
+		rolloverTrigger: make(chan bool, 1),
+		metrics:         registry,
+		mBatchLimit:     metrics.GetOrRegisterGauge("batch.limit", registry),
+	}
+}
+
+// ParseOutputs creates the outputs from the command line.
+func ParseOutputs() ([]*Output, error) {
+	if len(rawOutputs) == 0 {
+		urls := backendRawURLs
+		if len(urls) == 0 {
+			for _, host := range hosts {
+				urls = append(urls, fmt.Sprintf("%s://%s/", protocol, net.JoinHostPort(host, strconv.Itoa(port))))
+			}
+		}
+		result := []*Output{NewOutput(defaultOutputName, urls)}
+		return result, SetOutputOptions(result)
+	}
+
+	var (
+		result []*Output
+		seen   = map[string]bool{}
+	)
+	for _, raw := range rawOutputs {
+		parts := strings.SplitN(raw, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid output %q, expected NAME=URL[,URL...]", raw)
+		}
+		name := strings.TrimSpace(parts[0])
+		if !outputNameRegexp.MatchString(name) {
+			return nil, fmt.Errorf("Invalid output name %q", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("Duplicate output %q", name)
+		}
+		seen[name] = true
+		var urls []string
+		for _, u := range strings.Split(parts[1], ",") {
+			if u = strings.TrimSpace(u); u != "" {
+				urls = append(urls, u)
+			}
+		}
+		if len(urls) == 0 {
+			return nil, fmt.Errorf("No URL for output %q", name)
+		}
+		o := NewOutput(name, urls)
+		if strings.HasPrefix(urls[0], "file:") {
+			if len(urls) > 1 {
+				return nil, fmt.Errorf("A file output has a single URL: %q", raw)
+			}
+			var err error
+			if o.dir, err = ParseFileURL(urls[0]); err != nil {
+				return nil, err
+			}
+		}
+		result = append(result, o)
+	}
+	return result, SetOutputOptions(result)
+}
+
+// SetOutputOptions applies the --output-option switches.
+func SetOutputOptions(outputs []*Output) error {
+	flagSets := map[string]*pflag.FlagSet{}
+	sources := map[string]*CredentialSources{}
+	for _, o := range outputs {
+		flagSets[o.Name], sources[o.Name] = o.flagSet()
+	}
+	for _, raw := range rawOutputOptions {
+		var name, option, value string
+		if parts := strings.SplitN(raw, ":", 2); len(parts) == 2 {
+			name = strings.TrimSpace(parts[0])
+			if parts = strings.SplitN(parts[1], "=", 2); len(parts) == 2 {
+				option, value = strings.TrimSpace(parts[0]), parts[1]
+			}
+		}
+		if option == "" {
+			return fmt.Errorf("Invalid output option %q, expected NAME:SWITCH=VALUE", raw)
+		}
+		fs, found := flagSets[name]
+		if !found {
+			return fmt.Errorf("Unknown output %q in %q", name, raw)
+		}
+		if err := fs.Set(option, value); err != nil {
+			return fmt.Errorf("Invalid output option %q: %s", raw, err)
+		}
+	}
+	for _, o := range outputs {
+		if *sources[o.Name] != credentials.Sources {
+			o.credentials = &Credentials{Sources: *sources[o.Name]}
+		}
+	}
+	return nil
+}
+
+// flagSet returns the switches which can be set for the output only, and the sources of its credentials.
+func (o *Output) flagSet() (*pflag.FlagSet, *CredentialSources) {
+	fs := pflag.NewFlagSet(o.Name, pflag.ContinueOnError)
+	fs.StringVar(&o.indexPrefix, "index", o.indexPrefix, "")
+	fs.StringVar(&o.docType, "type", o.docType, "")
+	fs.IntVar(&o.batchSize, "batch-size", o.batchSize, "")
+	fs.DurationVar(&o.flushDelay, "flush-delay", o.flushDelay, "")
+	fs.StringVar(&o.indexTemplateFile, "index-template", o.indexTemplateFile, "")
+	fs.StringVar(&o.indexTemplateName, "index-template-name", o.indexTemplateName, "")
+	fs.StringVar(&o.ilmPolicyFile, "ilm-policy", o.ilmPolicyFile, "")
+	fs.StringVar(&o.ilmPolicyName, "ilm-policy-name", o.ilmPolicyName, "")
+	fs.StringVar(&o.healthCheckPath, "health-check-path", o.healthCheckPath, "")
+	fs.BoolVar(&o.sniff, "sniff", o.sniff, "")
+	fs.StringVar(&o.dataStream, "data-stream", o.dataStream, "")
+	fs.StringVar(&o.writeAlias, "write-alias", o.writeAlias, "")
+	fs.BoolVar(&o.awsSigV4, "aws-sigv4", o.awsSigV4, "")
+	fs.StringVar(&o.awsRegion, "aws-region", o.awsRegion, "")
+	fs.StringVar(&o.awsService, "aws-service", o.awsService, "")
+	fs.StringVar(&o.api, "api", o.api, "")
+	fs.StringSliceVar(&o.lokiLabels, "loki-labels", o.lokiLabels, "")
+	fs.StringVar(&o.lokiJob, "loki-job", o.lokiJob, "")
+	fs.StringVar(&o.clickhouseTable, "clickhouse-table", o.clickhouseTable, "")
+	fs.StringVar(&o.fileFormat, "file-format", o.fileFormat, "")
+	fs.Int64Var(&o.fileRotateSize, "file-rotate-size", o.fileRotateSize, "")
+	fs.DurationVar(&o.fileRotateInterval, "file-rotate-interval", o.fileRotateInterval, "")
+	fs.BoolVar(&o.fileGzip, "file-gzip", o.fileGzip, "")
+	sources := o.credentials.Sources
+	sources.AddFlags(fs)
+	return fs, &sources
+}
+
+// OutputNames returns the names of the outputs.
+func OutputNames() []string {
+	names := make([]string, len(outputs))
+	for i, o := range outputs {
+		names[i] = o.Name
+	}
+	return names
+}
+
+// RunOutputs starts a batcher and a requester for each output. It returns once all the batchers are done,
+// while the requesters send the last batchs.
+func RunOutputs() {
+	SetupRequests()
+
+	var batchers sync.WaitGroup
+	for _, o := range outputs {
+		batchers.Add(1)
+		endGroup.Add(1)
+		go func(o *Output) {
+			defer batchers.Done()
+			o.Batcher()
+		}(o)
+		go func(o *Output) {
+			defer endGroup.Done()
+			if o.IsFile() {
+				o.Archiver()
+			} else {
+				o.Requester()
+			}
+		}(o)
+	}
+	batchers.Wait()
+}
+
+// UsesDailyIndices tells whether the output sends the documents to daily indices, which need the "date" of the
+// messages.
+func (o *Output) UsesDailyIndices() bool {
+	return o.dataStream == "" && o.writeAlias == ""
+}
+
+// IsFile tells whether the output writes into files.
+func (o *Output) IsFile() bool {
+	return o.dir != ""
+}
+
+func (o *Output) String() string {
+	return o.Name
+}
@@ -0,0 +1,115 @@
+/*
+bilies-go - Bulk Insert Logs Into ElasticSearch
+Copyright (C) 2016 Adirelle <adirelle@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+/*
+
+APIs
+
+Besides the bulk API of ElasticSearch, the outputs can send the messages to other log stores, using their HTTP API.
+Whatever the API, the batchs go through the same backend pool, circuit breaker, rate limits and retries, but each
+API has its own request format and its own way of telling which errors are worth a retry. The index switches, the
+data streams, the write aliases and the bootstrapping only apply to ElasticSearch. Sniffing is not supported by
+the other APIs, so it must be disabled for their outputs, e.g. with "--output-option=loki:sniff=false".
+
+The following switch selects the API. It can be set for a given output with --output-option, e.g.
+"--output-option=siem:api=webhook":
+
+	--api=(elasticsearch|webhook|loki|clickhouse) [default: elasticsearch]
+		The API of the servers:
+		- elasticsearch: the bulk API of ElasticSearch or OpenSearch,
+		- webhook: a JSON array of the documents, posted to the URL as is,
+		- loki: the push API of Grafana Loki, see the Loki switches,
+		- clickhouse: an "INSERT ... FORMAT JSONEachRow" query, see the ClickHouse switches.
+*/
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+var (
+	api = "elasticsearch"
+
+	protocols = map[string]Protocol{}
+)
+
+func init() {
+	pflag.StringVar(&api, "api", api, "API of the servers: elasticsearch | webhook | loki | clickhouse")
+}
+
+// Protocol sends the batchs of an output to a kind of server, through its HTTP API.
+type Protocol interface {
+	// Check checks the settings of the output.
+	Check(o *Output) error
+
+	// Start prepares the servers once the backend pool of the output is ready, e.g. installs the index templates.
+	Start(o *Output)
+
+	// URL returns the URL of the requests sent to the backend.
+	URL(o *Output, u *BackendURL) string
+
+	// Request returns the body and the headers of the request sending the records between i and j.
+	Request(o *Output, buf *IndexedBuffer, i, j int) ([]byte, http.Header, error)
+
+	// Response reads the response of the server, and returns the error it reports, if any.
+	Response(resp *http.Response) (result interface{}, err error)
+
+	// Report handles the result of a request which needs no retry. It returns the positions of the records that the
+	// server rejected because it is overloaded, which are sent again later.
+	Report(o *Output, buf *IndexedBuffer, i int, result interface{}) (overloaded []int)
+
+	// IsBackendError tells whether the request should be retried, with another backend.
+	IsBackendError(err error) bool
+
+	// IsRejection tells whether the records have been rejected, so they should be split to find the culprit.
+	IsRejection(err error) bool
+}
+
+// AddProtocol registers the protocol of an API.
+func AddProtocol(name string, p Protocol) {
+	protocols[name] = p
+}
+
+// GetProtocol returns the protocol of an API.
+func GetProtocol(name string) (Protocol, error) {
+	if p, found := protocols[name]; found {
+		return p, nil
+	}
+	names := make([]string, 0, len(protocols))
+	for n := range protocols {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return nil, fmt.Errorf("Unknown API %q, expected one of %s", name, strings.Join(names, ", "))
+}
+
+// readErrorBody reads the beginning of the body of an error response, for the logs.
+func readErrorBody(resp *http.Response) string {
+	if resp.StatusCode < 400 {
+		return ""
+	}
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return strings.TrimSpace(string(b))
+}
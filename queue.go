@@ -22,10 +22,34 @@ Messages queueing
 
 Incoming messages are enqueued into LevelDB database.
 
-The following switch control queueing:
+Records are written in groups: all the records received while the previous group
+was being committed are written at once, in a single LevelDB batch.
+
+Each output reads the queue through its own cursor. With several outputs, the records acknowledged by some of
+them are marked as such, and they are removed once every output has acknowledged them. The records which are not
+routed to an output are acknowledged on its behalf when they are written.
+
+The queue has two lanes: high-priority records are always read before normal ones.
+A record is classified as high-priority when the field designated by --priority-field
+has one of the values listed by --priority-values. Field names are dot-separated paths
+into the input message, e.g. "log.severity".
+
+The following switches control queueing:
 
 	-q --queue-dir=STRING [default: $PWD/.queue]
 		Sets the path to the directoy hosting the LevelDB.
+
+	--queue-write-batch=INT [default: 1000]
+		The maximum number of records committed in a single write.
+
+	--queue-max-age=DURATION [default: 0]
+		Records older than this are not sent but moved to the dead letters (0 to disable).
+
+	--priority-field=STRING [default: none]
+		The field used to classify records.
+
+	--priority-values=STRING,... [default: emerg,alert,crit,err,error,critical,fatal]
+		The values of the priority field of high-priority records (case-insensitive).
 */
 package main
 
@@ -33,10 +57,13 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rcrowley/go-metrics"
+	"github.com/spf13/pflag"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/iterator"
 	"github.com/syndtr/goleveldb/leveldb/util"
@@ -51,53 +78,132 @@ var (
 	mQueue               = metrics.NewPrefixedChildRegistry(mRoot, "queue.")
 	mQueueWrittenBytes   = metrics.GetOrRegisterMeter("write.bytes", mQueue)
 	mQueueWrittenRecords = metrics.GetOrRegisterMeter("write.records", mQueue)
+	mQueueWriteBatch     = metrics.GetOrRegisterHistogram("write.batch", mQueue, NewSample())
 	mQueueReadBytes      = metrics.GetOrRegisterMeter("read.bytes", mQueue)
 	mQueueReadRecords    = metrics.GetOrRegisterMeter("read.records", mQueue)
 	mQueueLastWrittenID  = metrics.GetOrRegisterGauge("lastID.written", mQueue)
 	mQueueLastReadID     = metrics.GetOrRegisterGauge("lastID.read", mQueue)
 	mQueueLastDeletedID  = metrics.GetOrRegisterGauge("lastID.deleted", mQueue)
+	mQueueWrittenHigh    = metrics.GetOrRegisterMeter("write.high.records", mQueue)
 	mQueueLength         = metrics.GetOrRegisterHistogram("length.records", mQueue, NewSample())
 	mQueuePending        = metrics.GetOrRegisterHistogram("pending.records", mQueue, NewSample())
+	mQueueOldestAge      = metrics.GetOrRegisterGauge("oldest.time", mQueue)
+	mQueueExpired        = metrics.GetOrRegisterMeter("expired.records", mQueue)
 
 	queueCodecHandle = &codec.SimpleHandle{}
+
+	queueWriteBatch = 1000
+	queueMaxAge     time.Duration
+
+	priorityField  string
+	priorityValues = []string{"emerg", "alert", "crit", "err", "error", "critical", "fatal"}
 )
 
+func init() {
+	pflag.IntVar(&queueWriteBatch, "queue-write-batch", queueWriteBatch, "Maximum number of records committed in a single write")
+	pflag.DurationVar(&queueMaxAge, "queue-max-age", queueMaxAge, "Maximum age of queued records (0 to disable)")
+	pflag.StringVar(&priorityField, "priority-field", priorityField, "Field used to classify high-priority records")
+	pflag.StringSliceVar(&priorityValues, "priority-values", priorityValues, "Values of the priority field of high-priority records")
+}
+
+// RecordPriority classifies the record using its fields.
+func RecordPriority(fields *Fields) data.Priority {
+	if priorityField == "" {
+		return data.NormalPriority
+	}
+	if v, found := fields.GetString(priorityField); found {
+		for _, p := range priorityValues {
+			if strings.EqualFold(v, p) {
+				return data.HighPriority
+			}
+		}
+	}
+	return data.NormalPriority
+}
+
 type Queue struct {
-	WriteC chan<- data.Record
-	ReadC  <-chan data.Record
-	DropC  chan<- int
+	WriteC  chan<- []data.Record
+	Cursors []*Cursor
+
+	db      *leveldb.DB
+	acks    chan queueAck
+	expires chan []queueExpire
+	length  int64
+	pending int64
+	close   chan bool
+	ended   sync.WaitGroup
+}
 
-	db    *leveldb.DB
-	close chan bool
-	ended sync.WaitGroup
+// Cursor reads the records of the queue on behalf of an output.
+type Cursor struct {
+	Name  string
+	ReadC <-chan data.Record
+
+	q          *Queue
+	high       chan bool
+	lastReadID int64
+	pending    int64
+
+	mLastReadID metrics.Gauge
+	mPending    metrics.Histogram
 }
 
-func OpenQueue(path string) (*Queue, error) {
+type queueAck struct {
+	cursor *Cursor
+	keys   []DbKey
+}
+
+type queueExpire struct {
+	key DbKey
+	rec data.Record
+}
+
+// OpenQueue opens the queue, with a cursor for each of the named outputs. Duplicate records are suppressed if dedup is
+// true and the duplicate suppression switches are set.
+func OpenQueue(path string, names []string, dedup bool) (*Queue, error) {
 	db, err := leveldb.OpenFile(path, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	writeChan := make(chan data.Record)
-	readChan := make(chan data.Record)
-	dropChan := make(chan int)
+	writeChan := make(chan []data.Record)
 
 	q := &Queue{
-		db:     db,
-		WriteC: writeChan,
-		ReadC:  readChan,
-		DropC:  dropChan,
-		close:  make(chan bool),
+		db:      db,
+		WriteC:  writeChan,
+		acks:    make(chan queueAck),
+		expires: make(chan []queueExpire),
+		close:   make(chan bool),
+	}
+	if err = q.cleanAcks(names); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	readChans := make([]chan data.Record, len(names))
+	for i, name := range names {
+		readChans[i] = make(chan data.Record)
+		registry := metrics.NewPrefixedChildRegistry(mQueue, "cursor."+name+".")
+		q.Cursors = append(q.Cursors, &Cursor{
+			Name:        name,
+			ReadC:       readChans[i],
+			q:           q,
+			high:        make(chan bool, 1),
+			mLastReadID: metrics.GetOrRegisterGauge("lastID.read", registry),
+			mPending:    metrics.GetOrRegisterHistogram("pending.records", registry, NewSample()),
+		})
 	}
 
 	started := &sync.WaitGroup{}
-	started.Add(4)
+	started.Add(3 + len(names))
 
 	logger.Debug("Starting queue")
 
-	go q.processReads(readChan, started)
-	go q.processWrites(writeChan, started)
-	go q.processDrops(dropChan, started)
+	for i, c := range q.Cursors {
+		go q.processReads(c, readChans[i], started)
+	}
+	go q.processWrites(writeChan, dedup, started)
+	go q.processDrops(started)
 	go q.updateMetrics(started)
 
 	started.Wait()
@@ -106,26 +212,55 @@ func OpenQueue(path string) (*Queue, error) {
 	return q, nil
 }
 
+// Cursor returns the cursor of the named output, or nil.
+func (q *Queue) Cursor(name string) *Cursor {
+	for _, c := range q.Cursors {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Ack acknowledges the records of the given keys.
+func (c *Cursor) Ack(keys []DbKey) {
+	c.q.acks <- queueAck{c, keys}
+}
+
 func (q *Queue) Close() {
 	close(q.close)
 	q.ended.Wait()
 	q.db.Close()
 }
 
-func (q *Queue) processWrites(input chan data.Record, started *sync.WaitGroup) {
-	var (
-		iter = q.db.NewIterator(nil, nil)
+// lastKey returns the last key of the given lane.
+func (q *Queue) lastKey(p data.Priority) DbKey {
+	iter := q.db.NewIterator(laneRange(p, 0), nil)
+	defer iter.Release()
+	if iter.Last() {
+		return FromBytes(iter.Key())
+	}
+	return laneKey(p, 0)
+}
 
-		lastID DbKey
+func (q *Queue) processWrites(input chan []data.Record, suppressDuplicates bool, started *sync.WaitGroup) {
+	var (
+		lastIDs = map[data.Priority]DbKey{
+			data.NormalPriority: q.lastKey(data.NormalPriority),
+			data.HighPriority:   q.lastKey(data.HighPriority),
+		}
 
 		buf bytes.Buffer
 		enc = codec.NewEncoder(&buf, queueCodecHandle)
-	)
+		b   leveldb.Batch
 
-	if iter.Last() {
-		lastID = FromBytes(iter.Key())
+		dedup *DedupIndex
+	)
+	if suppressDuplicates {
+		dedup = NewDedupIndex(q.db)
+	} else if dedupWindow > 0 || dedupSize > 0 {
+		logger.Info("Duplicate suppression disabled")
 	}
-	iter.Release()
 
 	q.ended.Add(1)
 	defer q.ended.Done()
@@ -133,20 +268,71 @@ func (q *Queue) processWrites(input chan data.Record, started *sync.WaitGroup) {
 
 	for {
 		select {
-		case rec := <-input:
-			lastID++
-			buf.Reset()
-			enc.Reset(&buf)
-			if err := enc.Encode(&rec); err != nil {
-				logger.Errorf("Could not marshall record: %s", err)
+		case recs := <-input:
+			nextIDs := map[data.Priority]DbKey{}
+			for p, id := range lastIDs {
+				nextIDs[p] = id
+			}
+			count := 0
+			size := 0
+			high := 0
+			now := time.Now()
+			b.Reset()
+			for i := range recs {
+				checkID := dedup != nil && recs[i].ExplicitID
+				if checkID && dedup.IsDuplicate(recs[i].ID, now) {
+					mQueueDuplicates.Mark(1)
+					logger.Debugf("Dropped duplicate record %q", recs[i].ID)
+					continue
+				}
+				recs[i].QueuedAt = now.UnixNano()
+				buf.Reset()
+				enc.Reset(&buf)
+				if err := enc.Encode(&recs[i]); err != nil {
+					logger.Errorf("Could not marshall record: %s", err)
+					continue
+				}
+				if checkID {
+					dedup.Add(&b, recs[i].ID, now)
+				}
+				p := recs[i].Priority
+				nextIDs[p]++
+				b.Put(nextIDs[p].Bytes(), buf.Bytes())
+				q.skipOutputs(&b, nextIDs[p], recs[i].Outputs)
+				count++
+				size += buf.Len()
+				if p == data.HighPriority {
+					high++
+				}
+			}
+			if dedup != nil {
+				dedup.Evict(&b, now)
+			}
+			if b.Len() == 0 {
 				break
 			}
-			if err := q.db.Put(lastID.Bytes(), buf.Bytes(), nil); err == nil {
-				mQueueWrittenBytes.Mark(int64(buf.Len()))
-				mQueueWrittenRecords.Mark(1)
-				mQueueLastWrittenID.Update(int64(lastID))
+			err := q.db.Write(&b, nil)
+			if dedup != nil {
+				dedup.Commit(err == nil)
+			}
+			if err == nil {
+				lastIDs = nextIDs
+				atomic.AddInt64(&q.length, int64(count))
+				mQueueWrittenBytes.Mark(int64(size))
+				mQueueWrittenRecords.Mark(int64(count))
+				mQueueWrittenHigh.Mark(int64(high))
+				mQueueWriteBatch.Update(int64(count))
+				mQueueLastWrittenID.Update(int64(lastIDs[data.NormalPriority].Seq()))
+				if high > 0 {
+					for _, c := range q.Cursors {
+						select {
+						case c.high <- true:
+						default:
+						}
+					}
+				}
 			} else {
-				logger.Errorf("Could not write record to queue: %s", err)
+				logger.Errorf("Could not write %d records to queue: %s", count, err)
 			}
 		case <-q.close:
 			return
@@ -154,42 +340,82 @@ func (q *Queue) processWrites(input chan data.Record, started *sync.WaitGroup) {
 	}
 }
 
-func (q *Queue) processReads(output chan data.Record, started *sync.WaitGroup) {
+// processReads sends the records of the high-priority lane, then the ones of the normal lane.
+// It switches back to the high-priority lane as soon as high-priority records are written.
+func (q *Queue) processReads(c *Cursor, output chan data.Record, started *sync.WaitGroup) {
 	var (
-		iter   iterator.Iterator
-		lastID DbKey
-		rec    data.Record
+		iter    iterator.Iterator
+		lane    data.Priority
+		lastIDs = map[data.Priority]DbKey{}
+		rec     data.Record
 
 		ch    chan data.Record
 		delay <-chan time.Time
 
+		// The expired records are removed in groups
+		expired []queueExpire
+
 		dec = codec.NewDecoderBytes(nil, queueCodecHandle)
 	)
+	flushExpired := func() {
+		if len(expired) == 0 {
+			return
+		}
+		select {
+		case q.expires <- expired:
+		case <-q.close:
+		}
+		expired = nil
+	}
 
 	q.ended.Add(1)
 	defer q.ended.Done()
 	started.Done()
 
 	for {
-		if ch == nil {
+		if ch == nil && delay == nil {
 			if iter == nil {
-				iter = q.db.NewIterator(&util.Range{Start: lastID.Bytes()}, nil)
-				iter.First()
+				lane = data.HighPriority
+				iter = q.db.NewIterator(laneRange(lane, lastIDs[lane]), nil)
 			}
 			if iter.Next() {
-				lastID = FromBytes(iter.Key())
+				lastID := FromBytes(iter.Key())
+				lastIDs[lane] = lastID
+				rec = data.Record{}
 				dec.ResetBytes(iter.Value())
 				if err := dec.Decode(&rec); err != nil {
 					logger.Errorf("Could not unmarshall record: %s", err)
-				} else {
-					mQueueReadBytes.Mark(int64(len(iter.Value())))
-					mQueueReadRecords.Mark(1)
-					mQueueLastReadID.Update(int64(lastID))
-					ch = output
+					continue
+				}
+				if q.isExpired(rec) {
+					if expired = append(expired, queueExpire{lastID, rec}); len(expired) >= queueWriteBatch {
+						flushExpired()
+					}
+					continue
+				}
+				if q.isAcked(lastID, c) {
+					continue
 				}
+				rec.Key = uint64(lastID)
+				rec.Priority = lane
+				mQueueReadBytes.Mark(int64(len(iter.Value())))
+				mQueueReadRecords.Mark(1)
+				if lane == data.NormalPriority {
+					atomic.StoreInt64(&c.lastReadID, int64(lastID.Seq()))
+				}
+				atomic.AddInt64(&q.pending, 1)
+				atomic.AddInt64(&c.pending, 1)
+				ch = output
+				flushExpired()
 			} else {
+				flushExpired()
 				iter.Release()
 				iter = nil
+				if lane == data.HighPriority {
+					lane = data.NormalPriority
+					iter = q.db.NewIterator(laneRange(lane, lastIDs[lane]), nil)
+					continue
+				}
 				delay = time.After(flushDelay)
 			}
 		}
@@ -198,59 +424,200 @@ func (q *Queue) processReads(output chan data.Record, started *sync.WaitGroup) {
 			ch = nil
 		case <-delay:
 			delay = nil
+		case <-c.high:
+			if iter != nil {
+				iter.Release()
+				iter = nil
+			}
+			delay = nil
 		case <-q.close:
+			if iter != nil {
+				iter.Release()
+			}
 			return
 		}
 	}
 }
 
-func (q *Queue) processDrops(input chan int, started *sync.WaitGroup) {
+func (q *Queue) isExpired(rec data.Record) bool {
+	return queueMaxAge > 0 && rec.Age(time.Now()) > queueMaxAge
+}
+
+// skipOutputs acknowledges a new record on behalf of the outputs it is not routed to.
+func (q *Queue) skipOutputs(b *leveldb.Batch, key DbKey, outputs []string) {
+	if outputs == nil || len(q.Cursors) < 2 {
+		return
+	}
+	for _, c := range q.Cursors {
+		routed := false
+		for _, name := range outputs {
+			routed = routed || name == c.Name
+		}
+		if !routed {
+			b.Put(ackKey(key, c.Name), nil)
+		}
+	}
+}
+
+// isAcked tells whether the output of the cursor has already acknowledged the record.
+func (q *Queue) isAcked(key DbKey, c *Cursor) bool {
+	if len(q.Cursors) < 2 {
+		return false
+	}
+	found, _ := q.db.Has(ackKey(key, c.Name), nil)
+	return found
+}
+
+// expire moves expired records to the dead letters and removes them from the queue, unless they have already been
+// removed.
+func (q *Queue) expire(exps []queueExpire) {
+	b := leveldb.Batch{}
+	recs := make([]data.Record, 0, len(exps))
+	for _, exp := range exps {
+		if len(q.Cursors) > 1 {
+			if found, _ := q.db.Has(exp.key.Bytes(), nil); !found {
+				continue
+			}
+		}
+		q.deleteRecord(&b, exp.key)
+		recs = append(recs, exp.rec)
+	}
+	if len(recs) == 0 {
+		return
+	}
+	mQueueExpired.Mark(int64(len(recs)))
+	DeadLetter(fmt.Sprintf("queued for more than %s", queueMaxAge), recs...)
+	if err := q.db.Write(&b, nil); err == nil {
+		atomic.AddInt64(&q.length, -int64(len(recs)))
+	} else {
+		logger.Errorf("Could not remove %d expired records: %s", len(recs), err)
+	}
+}
+
+// deleteRecord deletes a record and its acknowledgements.
+func (q *Queue) deleteRecord(b *leveldb.Batch, key DbKey) {
+	b.Delete(key.Bytes())
+	if len(q.Cursors) > 1 {
+		for _, c := range q.Cursors {
+			b.Delete(ackKey(key, c.Name))
+		}
+	}
+}
+
+// drop deletes the records that every output has acknowledged, and marks the others as acknowledged
+// by the output of the cursor. It returns the number of deleted records.
+func (q *Queue) drop(b *leveldb.Batch, c *Cursor, keys []DbKey) (deleted int) {
+	var lastID DbKey
+	for _, key := range keys {
+		if len(q.Cursors) > 1 {
+			if found, _ := q.db.Has(key.Bytes(), nil); !found {
+				// Already expired
+				continue
+			}
+			acked := true
+			for _, other := range q.Cursors {
+				if other != c && !q.isAcked(key, other) {
+					acked = false
+					break
+				}
+			}
+			if !acked {
+				b.Put(ackKey(key, c.Name), nil)
+				continue
+			}
+		}
+		q.deleteRecord(b, key)
+		deleted++
+		if key.Priority() == data.NormalPriority && key > lastID {
+			lastID = key
+		}
+	}
+	if lastID > 0 {
+		mQueueLastDeletedID.Update(int64(lastID.Seq()))
+	}
+	return
+}
+
+func (q *Queue) processDrops(started *sync.WaitGroup) {
 	q.ended.Add(1)
 	defer q.ended.Done()
 	started.Done()
 
 	for {
 		select {
-		case n := <-input:
-			iter := q.db.NewIterator(nil, nil)
+		case ack := <-q.acks:
 			b := leveldb.Batch{}
-			var (
-				i      int
-				lastID DbKey
-			)
-			for found := iter.First(); i < n && found; found = iter.Next() {
-				b.Delete(iter.Key())
-				lastID = FromBytes(iter.Key())
-				i++
-			}
-			if lastID > 0 {
-				mQueueLastDeletedID.Update(int64(lastID))
-			}
+			deleted := q.drop(&b, ack.cursor, ack.keys)
 			if err := q.db.Write(&b, nil); err == nil {
-				logger.Debugf("Removed %d/%d records", i, n)
+				atomic.AddInt64(&q.length, -int64(deleted))
+				atomic.AddInt64(&q.pending, -int64(len(ack.keys)))
+				atomic.AddInt64(&ack.cursor.pending, -int64(len(ack.keys)))
+				logger.Debugf("Acknowledged %d records for %s, removed %d records", len(ack.keys), ack.cursor.Name, deleted)
 			} else {
-				logger.Debugf("Error removing record %d records: %s", n, err)
+				logger.Debugf("Error removing %d records: %s", len(ack.keys), err)
 			}
-			iter.Release()
+		case exps := <-q.expires:
+			q.expire(exps)
 		case <-q.close:
 			return
 		}
 	}
 }
 
+// cleanAcks removes the acknowledgements of the outputs which are not configured anymore, and of the
+// records which do not exist anymore. With a single output, all of them are removed.
+func (q *Queue) cleanAcks(names []string) error {
+	wanted := map[string]bool{}
+	if len(names) > 1 {
+		for _, name := range names {
+			wanted[name] = true
+		}
+	}
+	b := leveldb.Batch{}
+	iter := q.db.NewIterator(util.BytesPrefix(ackPrefix), nil)
+	for iter.Next() {
+		key, name := parseAckKey(iter.Key())
+		if wanted[name] {
+			if found, err := q.db.Has(key.Bytes(), nil); err != nil || found {
+				continue
+			}
+		}
+		b.Delete(append([]byte{}, iter.Key()...))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil || b.Len() == 0 {
+		return err
+	}
+	logger.Debugf("Removing %d stale acknowledgements", b.Len())
+	return q.db.Write(&b, nil)
+}
+
 func (q *Queue) updateMetrics(started *sync.WaitGroup) {
 	q.ended.Add(1)
 	defer q.ended.Done()
 	started.Done()
 
-	iter := q.db.NewIterator(nil, nil)
+	// Counting a large queue takes a while, so it is done once the queue is open. The readers and the writer update
+	// the length concurrently.
+	var length int64
+	iter := q.db.NewIterator(&util.Range{Limit: metaPrefix}, nil)
+	for iter.Next() {
+		length++
+	}
+	iter.Release()
+	atomic.AddInt64(&q.length, length)
+
+	iter = q.db.NewIterator(laneRange(data.NormalPriority, 0), nil)
 	if iter.First() {
-		firstID := int64(FromBytes(iter.Key()))
+		firstID := int64(FromBytes(iter.Key()).Seq())
+		for _, c := range q.Cursors {
+			atomic.StoreInt64(&c.lastReadID, firstID)
+		}
 		mQueueLastReadID.Update(firstID)
 		mQueueLastDeletedID.Update(firstID)
 	}
 	if iter.Last() {
-		mQueueLastWrittenID.Update(int64(FromBytes(iter.Key())))
+		mQueueLastWrittenID.Update(int64(FromBytes(iter.Key()).Seq()))
 	}
 	iter.Release()
 
@@ -259,26 +626,93 @@ func (q *Queue) updateMetrics(started *sync.WaitGroup) {
 
 	for {
 		select {
-		case <-t.C:
-			lastWritten := mQueueLastWrittenID.Value()
-			lastRead := mQueueLastReadID.Value()
-			lastDeleted := mQueueLastDeletedID.Value()
-			if lastDeleted > 0 {
-				if lastWritten >= lastDeleted {
-					mQueueLength.Update(lastWritten - lastDeleted)
-				}
-				if lastRead >= lastDeleted {
-					mQueuePending.Update(lastRead - lastDeleted)
+		case now := <-t.C:
+			mQueueOldestAge.Update(int64(q.oldestAge(now)))
+			mQueueLength.Update(atomic.LoadInt64(&q.length))
+			mQueuePending.Update(atomic.LoadInt64(&q.pending))
+			// The global read position is the one of the slowest output
+			var lastReadID int64 = -1
+			for _, c := range q.Cursors {
+				id := atomic.LoadInt64(&c.lastReadID)
+				c.mLastReadID.Update(id)
+				c.mPending.Update(atomic.LoadInt64(&c.pending))
+				if lastReadID < 0 || id < lastReadID {
+					lastReadID = id
 				}
 			}
+			if lastReadID >= 0 {
+				mQueueLastReadID.Update(lastReadID)
+			}
 		case <-q.close:
 			return
 		}
 	}
 }
 
+// highLaneBit is set in the keys of the high-priority lane.
+const highLaneBit DbKey = 1 << 63
+
+// oldestAge returns the age of the oldest record of both lanes.
+func (q *Queue) oldestAge(now time.Time) (age time.Duration) {
+	dec := codec.NewDecoderBytes(nil, queueCodecHandle)
+	for _, p := range []data.Priority{data.HighPriority, data.NormalPriority} {
+		iter := q.db.NewIterator(laneRange(p, 0), nil)
+		if iter.First() {
+			var rec data.Record
+			dec.ResetBytes(iter.Value())
+			if err := dec.Decode(&rec); err == nil && rec.Age(now) > age {
+				age = rec.Age(now)
+			}
+		}
+		iter.Release()
+	}
+	return
+}
+
+// metaPrefix is the prefix of the keys that do not hold records.
+var metaPrefix = []byte{0xff}
+
+// ackPrefix is the prefix of the acknowledgements, followed by the key of the record and the name of the output.
+var ackPrefix = append(append([]byte{}, metaPrefix...), 'a')
+
+// ackKey returns the key of the acknowledgement of a record by an output.
+func ackKey(key DbKey, name string) []byte {
+	b := make([]byte, 0, len(ackPrefix)+8+len(name))
+	b = append(b, ackPrefix...)
+	b = append(b, key.Bytes()...)
+	return append(b, name...)
+}
+
+// parseAckKey returns the key of the record and the name of the output of an acknowledgement.
+func parseAckKey(b []byte) (DbKey, string) {
+	b = b[len(ackPrefix):]
+	if len(b) < 8 {
+		return 0, ""
+	}
+	return FromBytes(b[:8]), string(b[8:])
+}
+
 type DbKey uint64
 
+// laneKey returns the key of the nth record of a lane.
+func laneKey(p data.Priority, n uint64) DbKey {
+	if p == data.HighPriority {
+		return highLaneBit | DbKey(n)
+	}
+	return DbKey(n)
+}
+
+// laneRange returns the range of the keys of a lane, following the given key.
+func laneRange(p data.Priority, after DbKey) *util.Range {
+	if after < laneKey(p, 0) {
+		after = laneKey(p, 0)
+	}
+	if p == data.HighPriority {
+		return &util.Range{Start: (after + 1).Bytes(), Limit: metaPrefix}
+	}
+	return &util.Range{Start: (after + 1).Bytes(), Limit: highLaneBit.Bytes()}
+}
+
 func FromBytes(b []byte) DbKey {
 	if len(b) != 8 || b == nil {
 		return DbKey(0)
@@ -286,6 +720,19 @@ func FromBytes(b []byte) DbKey {
 	return DbKey(converter.Uint64(b))
 }
 
+// Priority returns the lane of the key.
+func (k DbKey) Priority() data.Priority {
+	if k&highLaneBit != 0 {
+		return data.HighPriority
+	}
+	return data.NormalPriority
+}
+
+// Seq returns the sequence number of the key in its lane.
+func (k DbKey) Seq() uint64 {
+	return uint64(k &^ highLaneBit)
+}
+
 func (k DbKey) Bytes() []byte {
 	if k == 0 {
 		return nil
@@ -0,0 +1,323 @@
+/*
+bilies-go - Bulk Insert Logs Into ElasticSearch
+Copyright (C) 2016 Adirelle <adirelle@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Adirelle/bilies-go/data"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// openTestQueue opens a queue in dir and closes it at the end of the test.
+func openTestQueue(t *testing.T, dir string, names ...string) *Queue {
+	q, err := OpenQueue(dir, names, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(q.Close)
+	return q
+}
+
+// writeTestRecords writes records with the given IDs to the queue and waits for them to be committed.
+func writeTestRecords(q *Queue, p data.Priority, ids ...string) {
+	recs := make([]data.Record, len(ids))
+	for i, id := range ids {
+		recs[i] = data.Record{ID: id, Suffix: "2016.10.01", Document: `{"message":"test"}`, Priority: p}
+	}
+	q.WriteC <- recs
+	q.WriteC <- nil
+}
+
+// readTestRecords reads n records from the cursor and returns their IDs.
+func readTestRecords(t *testing.T, c *Cursor, n int) (ids []string) {
+	for _, rec := range readRecords(t, c, n) {
+		ids = append(ids, rec.ID)
+	}
+	return
+}
+
+// readRecords reads n records from the cursor.
+func readRecords(t *testing.T, c *Cursor, n int) (recs []data.Record) {
+	for i := 0; i < n; i++ {
+		select {
+		case rec := <-c.ReadC:
+			recs = append(recs, rec)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s timed out after reading %d records", c.Name, len(recs))
+		}
+	}
+	return
+}
+
+// countRecords returns the number of records stored in the queue.
+func countRecords(q *Queue) (n int) {
+	iter := q.db.NewIterator(&util.Range{Limit: metaPrefix}, nil)
+	defer iter.Release()
+	for iter.Next() {
+		n++
+	}
+	return
+}
+
+// countLines returns the number of lines of a file, or 0 if it does not exist.
+func countLines(path string) (n int) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	for s := bufio.NewScanner(f); s.Scan(); {
+		n++
+	}
+	return
+}
+
+func TestQueueExpiry(t *testing.T) {
+	// The queue is closed by a cleanup function, which must run before this one
+	oldMaxAge, oldFile := queueMaxAge, deadLetterFile
+	t.Cleanup(func() {
+		queueMaxAge, deadLetterFile = oldMaxAge, oldFile
+	})
+	queueMaxAge = 0
+	deadLetterFile = filepath.Join(t.TempDir(), "dead-letters.json")
+
+	dir := t.TempDir()
+	q, err := OpenQueue(dir, []string{defaultOutputName}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestRecords(q, data.NormalPriority, "a", "b", "c")
+	q.Close()
+
+	time.Sleep(20 * time.Millisecond)
+	queueMaxAge = 10 * time.Millisecond
+	q = openTestQueue(t, dir, defaultOutputName)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for countLines(deadLetterFile) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 3 dead letters, got %d", countLines(deadLetterFile))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The records are removed after being dead-lettered
+	for countRecords(q) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the expired records to be removed, %d remain", countRecords(q))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case rec := <-q.Cursor(defaultOutputName).ReadC:
+		t.Errorf("expected no record to be read, got %q", rec.ID)
+	default:
+	}
+	if n := countLines(deadLetterFile); n != 3 {
+		t.Errorf("expected 3 dead letters, got %d", n)
+	}
+}
+
+// BenchmarkQueueWrites compares per-record writes with group commits of several sizes.
+func BenchmarkQueueWrites(b *testing.B) {
+	for _, size := range []int{1, 10, 100, 1000} {
+		name := "group-commit-" + fmt.Sprint(size)
+		if size == 1 {
+			name = "per-record"
+		}
+		b.Run(name, func(b *testing.B) {
+			q, err := OpenQueue(b.TempDir(), []string{defaultOutputName}, true)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer q.Close()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i += size {
+				n := size
+				if b.N-i < n {
+					n = b.N - i
+				}
+				recs := make([]data.Record, n)
+				for j := range recs {
+					recs[j] = data.Record{Suffix: "2016.10.01", Document: `{"message":"benchmark"}`}
+				}
+				q.WriteC <- recs
+			}
+			// Wait for the last group to be committed
+			q.WriteC <- nil
+			b.StopTimer()
+		})
+	}
+}
+
+func TestQueueReadsHighLaneFirst(t *testing.T) {
+	dir := t.TempDir()
+	q, err := OpenQueue(dir, []string{defaultOutputName}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestRecords(q, data.NormalPriority, "normal1", "normal2")
+	writeTestRecords(q, data.HighPriority, "high1", "high2")
+	q.Close()
+
+	q = openTestQueue(t, dir, defaultOutputName)
+	ids := readTestRecords(t, q.Cursor(defaultOutputName), 4)
+	if fmt.Sprint(ids) != "[high1 high2 normal1 normal2]" {
+		t.Errorf("unexpected read order: %v", ids)
+	}
+}
+
+func TestQueueOldestAge(t *testing.T) {
+	lanes := []struct {
+		name         string
+		older, newer data.Priority
+	}{
+		{"normal-lane-older", data.NormalPriority, data.HighPriority},
+		{"high-lane-older", data.HighPriority, data.NormalPriority},
+	}
+	for _, l := range lanes {
+		t.Run(l.name, func(t *testing.T) {
+			q := openTestQueue(t, t.TempDir(), defaultOutputName)
+			if age := q.oldestAge(time.Now()); age != 0 {
+				t.Errorf("expected no age for an empty queue, got %s", age)
+			}
+			writeTestRecords(q, l.older, "older")
+			time.Sleep(50 * time.Millisecond)
+			writeTestRecords(q, l.newer, "newer")
+			if age := q.oldestAge(time.Now()); age < 50*time.Millisecond {
+				t.Errorf("expected the age of the older record, got %s", age)
+			}
+		})
+	}
+}
+
+// ackTestRecords acks the records for the cursor, and waits for the acknowledgement to be written.
+func ackTestRecords(c *Cursor, recs ...data.Record) {
+	keys := make([]DbKey, len(recs))
+	for i, rec := range recs {
+		keys[i] = DbKey(rec.Key)
+	}
+	c.Ack(keys)
+	// The acknowledgements are handled in order
+	c.Ack(nil)
+}
+
+// readNothing checks that the cursor reads no record.
+func readNothing(t *testing.T, c *Cursor) {
+	select {
+	case rec := <-c.ReadC:
+		t.Errorf("expected %s to read no record, got %q", c.Name, rec.ID)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// hasAck tells whether the record has been acknowledged by the named output.
+func hasAck(q *Queue, rec data.Record, name string) bool {
+	found, _ := q.db.Has(ackKey(DbKey(rec.Key), name), nil)
+	return found
+}
+
+func TestQueueDeletesAfterAllOutputs(t *testing.T) {
+	q := openTestQueue(t, t.TempDir(), "main", "siem")
+	writeTestRecords(q, data.NormalPriority, "a")
+	main, siem := q.Cursor("main"), q.Cursor("siem")
+	rec := readRecords(t, main, 1)[0]
+	readRecords(t, siem, 1)
+
+	ackTestRecords(main, rec)
+	if n := countRecords(q); n != 1 {
+		t.Errorf("expected the record to be kept until both outputs ack it, got %d records", n)
+	}
+	if !hasAck(q, rec, "main") {
+		t.Error("expected the acknowledgement of main to be stored")
+	}
+
+	ackTestRecords(siem, rec)
+	if n := countRecords(q); n != 0 {
+		t.Errorf("expected the record to be deleted, got %d records", n)
+	}
+	if hasAck(q, rec, "main") || hasAck(q, rec, "siem") {
+		t.Error("expected the acknowledgements to be deleted with the record")
+	}
+}
+
+func TestQueueDeletesRoutedRecords(t *testing.T) {
+	q := openTestQueue(t, t.TempDir(), "main", "siem")
+	q.WriteC <- []data.Record{{ID: "a", Suffix: "2016.10.01", Document: `{}`, Outputs: []string{"main"}}}
+	q.WriteC <- nil
+	main, siem := q.Cursor("main"), q.Cursor("siem")
+
+	rec := readRecords(t, main, 1)[0]
+	readNothing(t, siem)
+	ackTestRecords(main, rec)
+	if n := countRecords(q); n != 0 {
+		t.Errorf("expected the record to be deleted on the ack of its only output, got %d records", n)
+	}
+	if hasAck(q, rec, "siem") {
+		t.Error("expected the acknowledgements to be deleted with the record")
+	}
+}
+
+func TestQueueAcksSurviveReopen(t *testing.T) {
+	dir := t.TempDir()
+	q, err := OpenQueue(dir, []string{"main", "siem", "archive"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestRecords(q, data.NormalPriority, "a", "b")
+	recs := readRecords(t, q.Cursor("main"), 2)
+	ackTestRecords(q.Cursor("main"), recs...)
+	ackTestRecords(q.Cursor("archive"), readRecords(t, q.Cursor("archive"), 1)...)
+	q.Close()
+
+	q, err = OpenQueue(dir, []string{"main", "siem", "archive"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readNothing(t, q.Cursor("main"))
+	if ids := readTestRecords(t, q.Cursor("archive"), 1); ids[0] != "b" {
+		t.Errorf("expected archive to read the record it did not ack, got %q", ids[0])
+	}
+	if ids := readTestRecords(t, q.Cursor("siem"), 2); fmt.Sprint(ids) != "[a b]" {
+		t.Errorf("expected siem to read both records, got %v", ids)
+	}
+	q.Close()
+
+	// The acknowledgements of a removed output are pruned
+	q = openTestQueue(t, dir, "main", "siem")
+	if hasAck(q, recs[0], "archive") {
+		t.Error("expected the acknowledgement of the removed output to be pruned")
+	}
+	for _, rec := range recs {
+		if !hasAck(q, rec, "main") {
+			t.Errorf("expected the acknowledgement of %q by main to be kept", rec.ID)
+		}
+	}
+	readNothing(t, q.Cursor("main"))
+	ackTestRecords(q.Cursor("siem"), readRecords(t, q.Cursor("siem"), 2)...)
+	if n := countRecords(q); n != 0 {
+		t.Errorf("expected the records to be deleted, got %d records", n)
+	}
+}
@@ -0,0 +1,221 @@
+/*
+bilies-go - Bulk Insert Logs Into ElasticSearch
+Copyright (C) 2016 Adirelle <adirelle@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+/*
+
+Rate limiting
+
+The outgoing traffic can be limited, in documents and in bytes per second. The excess is kept in the queue.
+The limits apply to each output. The bytes are those of the request bodies, in the format of the output API, or
+those written by the file outputs, before compression.
+The limits can be changed at runtime by writing them into a file, and sending a HUP signal to the process.
+The file contains one limit per line, e.g.:
+
+	# Business hours
+	docs=5000
+	bytes=10485760
+
+A missing or zero limit means no limit. The following switches control the rate limiting:
+
+	--rate-docs=FLOAT [default: 0]
+		Maximum number of documents sent per second (0 for no limit).
+
+	--rate-bytes=FLOAT [default: 0]
+		Maximum number of bytes sent per second (0 for no limit).
+
+	--rate-file=STRING [default: none]
+		Read the limits from that file, at startup and on SIGHUP. Overrides --rate-docs and --rate-bytes.
+*/
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/spf13/pflag"
+)
+
+var (
+	rateDocs  float64
+	rateBytes float64
+	rateFile  string
+
+	mRateLimit      = metrics.NewPrefixedChildRegistry(mRoot, "ratelimit.")
+	mRateLimitDocs  = metrics.GetOrRegisterGaugeFloat64("docs", mRateLimit)
+	mRateLimitBytes = metrics.GetOrRegisterGaugeFloat64("bytes", mRateLimit)
+	mRateLimitWait  = metrics.GetOrRegisterTimer("wait.time", mRateLimit)
+)
+
+func init() {
+	pflag.Float64Var(&rateDocs, "rate-docs", rateDocs, "Maximum number of documents sent per second (0 for no limit)")
+	pflag.Float64Var(&rateBytes, "rate-bytes", rateBytes, "Maximum number of bytes sent per second (0 for no limit)")
+	pflag.StringVar(&rateFile, "rate-file", rateFile, "Read the rate limits from that file")
+
+	AddBackgroundTask("Rate limit reloader", RateLimitReloader)
+}
+
+// TokenBucket limits a rate of events. The bucket holds at most one second of events.
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// SetRate changes the rate of the bucket, in events per second. Zero means no limit.
+func (b *TokenBucket) SetRate(rate float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rate = rate
+	if b.tokens > rate {
+		b.tokens = rate
+	}
+}
+
+// Take takes n tokens from the bucket and returns how long to wait for the bucket to refill.
+// The bucket can go into debt, so events larger than the bucket are delayed instead of blocked.
+func (b *TokenBucket) Take(n float64, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate <= 0 {
+		return 0
+	}
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+	} else {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// WaitForRateLimits waits until a batch of the given number of documents and bytes can be sent.
+// It returns false on shutdown.
+func (o *Output) WaitForRateLimits(docs, bytes int) bool {
+	now := time.Now()
+	wait := o.docsLimiter.Take(float64(docs), now)
+	if w := o.bytesLimiter.Take(float64(bytes), now); w > wait {
+		wait = w
+	}
+	if wait <= 0 {
+		return true
+	}
+	logger.Debugf("Rate limited, waiting %s before sending to %s", wait, o)
+	mRateLimitWait.Update(wait)
+	select {
+	case <-time.After(wait):
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// SetRateLimits applies the rate limits.
+func SetRateLimits(docs, bytes float64) {
+	for _, o := range outputs {
+		o.docsLimiter.SetRate(docs)
+		o.bytesLimiter.SetRate(bytes)
+	}
+	mRateLimitDocs.Update(docs)
+	mRateLimitBytes.Update(bytes)
+}
+
+// ReadRateLimits reads the rate limits from the rate file.
+func ReadRateLimits() (docs, bytes float64, err error) {
+	f, err := os.Open(rateFile)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return 0, 0, fmt.Errorf("%s:%d: expected name=value", rateFile, n)
+		}
+		value, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil || value < 0 {
+			return 0, 0, fmt.Errorf("%s:%d: invalid limit %q", rateFile, n, parts[1])
+		}
+		switch strings.TrimSpace(parts[0]) {
+		case "docs":
+			docs = value
+		case "bytes":
+			bytes = value
+		default:
+			return 0, 0, fmt.Errorf("%s:%d: unknown limit %q", rateFile, n, parts[0])
+		}
+	}
+	err = s.Err()
+	return
+}
+
+// LoadRateLimits sets the initial rate limits.
+func LoadRateLimits() error {
+	if rateFile == "" {
+		SetRateLimits(rateDocs, rateBytes)
+		return nil
+	}
+	docs, bytes, err := ReadRateLimits()
+	if err == nil {
+		SetRateLimits(docs, bytes)
+	}
+	return err
+}
+
+// RateLimitReloader reloads the rate file on SIGHUP.
+func RateLimitReloader() {
+	if rateFile == "" {
+		return
+	}
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	defer signal.Stop(sigChan)
+	for {
+		select {
+		case <-sigChan:
+			if docs, bytes, err := ReadRateLimits(); err == nil {
+				SetRateLimits(docs, bytes)
+				logger.Noticef("Received SIGHUP, rate limits set to %g docs/s and %g bytes/s", docs, bytes)
+			} else {
+				logger.Errorf("Could not read rate limits, keeping the previous ones: %s", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
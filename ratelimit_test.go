@@ -0,0 +1,110 @@
+/*
+bilies-go - Bulk Insert Logs Into ElasticSearch
+Copyright (C) 2016 Adirelle <adirelle@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketUnlimited(t *testing.T) {
+	var b TokenBucket
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		if w := b.Take(1e6, now); w != 0 {
+			t.Fatalf("expected no wait without a rate, got %s", w)
+		}
+	}
+}
+
+func TestTokenBucketTake(t *testing.T) {
+	var b TokenBucket
+	b.SetRate(100)
+	now := time.Date(2016, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	// The bucket starts full
+	if w := b.Take(100, now); w != 0 {
+		t.Errorf("expected a full bucket, got a wait of %s", w)
+	}
+	// Then goes into debt
+	if w := b.Take(50, now); w != 500*time.Millisecond {
+		t.Errorf("expected a wait of 500ms, got %s", w)
+	}
+	// And refills at the given rate
+	now = now.Add(time.Second)
+	if w := b.Take(50, now); w != 0 {
+		t.Errorf("expected a refilled bucket, got a wait of %s", w)
+	}
+	// But not beyond its capacity
+	now = now.Add(time.Hour)
+	if w := b.Take(150, now); w != 500*time.Millisecond {
+		t.Errorf("expected a wait of 500ms, got %s", w)
+	}
+}
+
+func TestTokenBucketSetRate(t *testing.T) {
+	var b TokenBucket
+	b.SetRate(1000)
+	now := time.Date(2016, 10, 1, 12, 0, 0, 0, time.UTC)
+	b.Take(0, now)
+
+	// Lowering the rate caps the tokens
+	b.SetRate(10)
+	if w := b.Take(20, now); w != time.Second {
+		t.Errorf("expected a wait of 1s, got %s", w)
+	}
+	// Zero disables the limit
+	b.SetRate(0)
+	if w := b.Take(1000, now); w != 0 {
+		t.Errorf("expected no wait, got %s", w)
+	}
+}
+
+func TestReadRateLimits(t *testing.T) {
+	oldRateFile := rateFile
+	defer func() { rateFile = oldRateFile }()
+	rateFile = filepath.Join(t.TempDir(), "rates")
+
+	for content, expected := range map[string][2]float64{
+		"docs=500\nbytes=1048576\n":      {500, 1048576},
+		"# comment\n\n  docs = 10.5  \n": {10.5, 0},
+		"":                               {0, 0},
+	} {
+		if err := ioutil.WriteFile(rateFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		docs, bytes, err := ReadRateLimits()
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", content, err)
+		} else if docs != expected[0] || bytes != expected[1] {
+			t.Errorf("%q: expected %v, got %v and %v", content, expected, docs, bytes)
+		}
+	}
+
+	for _, content := range []string{"docs\n", "docs=-1\n", "docs=x\n", "requests=10\n"} {
+		if err := ioutil.WriteFile(rateFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := ReadRateLimits(); err == nil {
+			t.Errorf("%q: expected an error", content)
+		}
+	}
+}
@@ -24,23 +24,34 @@ bilies-go waits for JSON messages on its standard input. They should have the fo
 
 	{"date:"YYYY.MM.DD", "id":"some unique idd", "log":{"foo":"bar"}}
 
-The "id" is optional; if missing, a time-based UUID is generated. It is used to identify the document in ElasticSearch. Invalid messages are ignored and logged.
+The "id" is optional. It is used to identify the document in ElasticSearch. The "date" is optional with data
+streams and write aliases. Invalid messages are ignored and logged.
 
 bilies-go expects UTF-8 messages (as JSON). In case the input is not a valid UTF-8 strings, a charset conversion is tried.
 
-The following switch controls input reading:
+The following switches control input reading:
 
 	-c --input-charset=STRING [default: ISO-8859-1]
 		Alternative charset, in case the input is a not UTF-8 string.
+
+	--id-mode=(uuid|hash|none) [default: uuid]
+		How to identify documents without "id": "uuid" generates a time-based UUID, "hash" derives the ID from
+		the content of the document, so that sending the same document twice does not create a duplicate,
+		and "none" lets ElasticSearch generate the ID.
+
+	--id-fields=STRING,... [default: none]
+		In "hash" mode, only hash these fields of the message, e.g. "log.host,log.message".
 */
 package main
 
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha1"
 	"encoding/base64"
 	"io"
 	"os"
+	"time"
 	"unicode/utf8"
 
 	"github.com/landjur/golibrary/uuid"
@@ -59,16 +70,22 @@ var (
 	mInBytes   = metrics.GetOrRegisterMeter("in.bytes", mReader)
 	mInErrors  = metrics.GetOrRegisterMeter("in.errors", mReader)
 
-	reader = os.Stdin
+	reader io.Reader = os.Stdin
 
 	lines    = make(chan []byte)
 	linesReq = make(chan bool)
 
+	// Map keys are sorted so that hashes do not depend on the order of fields.
+	idCodecHandle = &codec.JsonHandle{BasicHandle: codec.BasicHandle{EncodeOptions: codec.EncodeOptions{Canonical: true}}}
+
 	// This is used for the synchronisation with the batcher
 	readerDone = make(chan bool)
 
 	// Charset to try to convert from when given invalid UTF-8.
 	inputCharset = "ISO-8859-1"
+
+	idMode   = "uuid"
+	idFields []string
 )
 
 func init() {
@@ -76,6 +93,8 @@ func init() {
 	AddMainTask("Record parser", RecordParser)
 
 	pflag.StringVarP(&inputCharset, "input-charset", "c", inputCharset, "Expected charset for invalid UTF-8 input")
+	pflag.StringVar(&idMode, "id-mode", idMode, "ID of documents without one: uuid | hash | none")
+	pflag.StringSliceVar(&idFields, "id-fields", idFields, "Fields to hash in hash ID mode")
 }
 
 // LineReader reads lines from input on demand.
@@ -115,47 +134,129 @@ func LineReader() {
 	}
 }
 
-// RecordParser requests Line from LineReader, converts them to InputRecords, and send them to the RecordQueuer.
+// RecordParser requests Line from LineReader, converts them to Records, and send them to the queue.
+//
+// Records are sent in groups: while the queue is busy writing the previous group, the parser keeps
+// reading lines, up to queueWriteBatch records.
 func RecordParser() {
+	if idMode != "uuid" && idMode != "hash" && idMode != "none" {
+		logger.Fatalf("Invalid ID mode: %q", idMode)
+	}
+
 	dec := codec.NewDecoderBytes(nil, &codec.JsonHandle{})
 	defer close(linesReq)
 	defer close(readerDone)
-	ever := true
-	req := linesReq
-	for ever {
-		var buf []byte
-		select {
-		case buf, ever = <-lines:
-			if buf == nil {
-				break
-			}
+
+	var (
+		input   = lines
+		waiting bool
+		pending []data.Record
+
+		req    chan<- bool
+		output chan<- []data.Record
+	)
+
+	for input != nil || len(pending) > 0 {
+		req, output = nil, nil
+		if input != nil && !waiting && len(pending) < queueWriteBatch {
 			req = linesReq
+		}
+		if len(pending) > 0 {
+			output = queue.WriteC
+		}
 
-			dec.ResetBytes(buf)
-			var inRec data.InputRecord
-			if err := dec.Decode(&inRec); err != nil {
-				logger.Errorf("Invalid JSON, %s: %q", err, buf)
-				mInErrors.Mark(1)
-				break
-			}
-			if inRec.Suffix == "" || len(inRec.Document) == 0 {
-				logger.Errorf("Malformed record: %q", buf)
-				mInErrors.Mark(1)
+		select {
+		case buf, ok := <-input:
+			waiting = false
+			if !ok {
+				input = nil
 				break
 			}
-			if inRec.ID == "" {
-				if uuid, err := uuid.NewTimeBased(); err == nil {
-					inRec.ID = base64.RawURLEncoding.EncodeToString(uuid[:])
-				} else {
-					logger.Errorf("Could not generate an UUID: %s", err)
-				}
+			if rec, ok := ParseRecord(dec, buf); ok {
+				pending = append(pending, rec)
 			}
-			mInRecords.Mark(1)
-			queue.WriteC <- inRec.Record()
+		case output <- pending:
+			pending = make([]data.Record, 0, len(pending))
+		case req <- true:
+			waiting = true
 		case <-done:
+			// The queue is closed after the main tasks, so the parsed records can still be written
+			if len(pending) > 0 {
+				queue.WriteC <- pending
+			}
+			return
+		}
+	}
+}
+
+// ParseRecord decodes a line into a Record. It returns false if the line is not a valid record.
+func ParseRecord(dec *codec.Decoder, buf []byte) (rec data.Record, ok bool) {
+	dec.ResetBytes(buf)
+	var inRec data.InputRecord
+	if err := dec.Decode(&inRec); err != nil {
+		logger.Errorf("Invalid JSON, %s: %q", err, buf)
+		mInErrors.Mark(1)
+		return
+	}
+	if (inRec.Suffix == "" && NeedsDate()) || len(inRec.Document) == 0 {
+		logger.Errorf("Malformed record: %q", buf)
+		mInErrors.Mark(1)
+		return
+	}
+	fields := NewFields(buf)
+	// Hash the document as read, so the IDs do not depend on the time @timestamp is added
+	explicitID := inRec.ID != ""
+	if !explicitID {
+		inRec.ID = GenerateID(inRec, fields)
+	}
+	if UsesDataStreams() {
+		var err error
+		if inRec.Document, err = SetTimestamp(inRec.Document, fields, time.Now()); err != nil {
+			logger.Errorf("%s: %q", err, buf)
+			mInErrors.Mark(1)
 			return
-		case req <- true:
-			req = nil
 		}
 	}
+	mInRecords.Mark(1)
+	rec = inRec.Record()
+	rec.ExplicitID = explicitID
+	rec.Priority = RecordPriority(fields)
+	if rec.Outputs = RouteRecord(fields); rec.Outputs != nil && len(rec.Outputs) == 0 {
+		logger.Debugf("Dropped unrouted record: %q", buf)
+		mRoutingDropped.Mark(1)
+		return rec, false
+	}
+	return rec, true
+}
+
+// GenerateID generates the ID of a record, according to --id-mode.
+func GenerateID(inRec data.InputRecord, fields *Fields) string {
+	switch idMode {
+	case "hash":
+		h := sha1.New()
+		if len(idFields) == 0 {
+			h.Write(inRec.Document)
+		} else {
+			enc := codec.NewEncoder(h, idCodecHandle)
+			for _, name := range idFields {
+				h.Write([]byte(name))
+				if v, found := fields.Get(name); found {
+					h.Write([]byte{'='})
+					if err := enc.Encode(v); err != nil {
+						logger.Errorf("Could not hash field %q: %s", name, err)
+					}
+				}
+				h.Write([]byte{0})
+			}
+		}
+		return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+	case "none":
+		return ""
+	}
+	id, err := uuid.NewTimeBased()
+	if err != nil {
+		logger.Errorf("Could not generate an UUID: %s", err)
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(id[:])
 }
@@ -0,0 +1,171 @@
+/*
+bilies-go - Bulk Insert Logs Into ElasticSearch
+Copyright (C) 2016 Adirelle <adirelle@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ugorji/go/codec"
+
+	"github.com/Adirelle/bilies-go/data"
+)
+
+func withIDMode(mode string, fields []string) func() {
+	oldMode, oldFields := idMode, idFields
+	idMode, idFields = mode, fields
+	return func() { idMode, idFields = oldMode, oldFields }
+}
+
+func generateID(line string) string {
+	var inRec data.InputRecord
+	if err := json.Unmarshal([]byte(line), &inRec); err != nil {
+		panic(err)
+	}
+	return GenerateID(inRec, NewFields([]byte(line)))
+}
+
+func generateDocument(line string) json.RawMessage {
+	var inRec data.InputRecord
+	if err := json.Unmarshal([]byte(line), &inRec); err != nil {
+		panic(err)
+	}
+	return inRec.Document
+}
+
+func TestGenerateIDHashDocument(t *testing.T) {
+	defer withIDMode("hash", nil)()
+
+	a := generateID(`{"date":"d","log":{"msg":"a","n":1}}`)
+	if a == "" {
+		t.Fatal("expected an ID")
+	}
+	if b := generateID(`{"date":"d","log":{"msg":"a","n":1}}`); b != a {
+		t.Errorf("same document, expected %q, got %q", a, b)
+	}
+	if b := generateID(`{"date":"d","log":{"msg":"b","n":1}}`); b == a {
+		t.Errorf("different documents, both got %q", a)
+	}
+}
+
+func TestGenerateIDHashFields(t *testing.T) {
+	defer withIDMode("hash", []string{"log.host", "log.seq"})()
+
+	a := generateID(`{"date":"d","log":{"host":"h1","seq":1,"msg":"a"}}`)
+	if b := generateID(`{"date":"d","log":{"msg":"other","seq":1,"host":"h1"}}`); b != a {
+		t.Errorf("same fields, expected %q, got %q", a, b)
+	}
+	if b := generateID(`{"date":"d","log":{"host":"h1","seq":2,"msg":"a"}}`); b == a {
+		t.Errorf("different fields, both got %q", a)
+	}
+	if b := generateID(`{"date":"d","log":{"seq":1,"msg":"a"}}`); b == a {
+		t.Errorf("missing field, got the same ID %q", a)
+	}
+}
+
+func TestGenerateIDNone(t *testing.T) {
+	defer withIDMode("none", nil)()
+
+	if id := generateID(`{"date":"d","log":{"msg":"a"}}`); id != "" {
+		t.Errorf("expected no ID, got %q", id)
+	}
+}
+
+func TestParseRecordHashIgnoresAddedTimestamp(t *testing.T) {
+	defer withIDMode("hash", nil)()
+	oldOutputs := outputs
+	outputs = []*Output{{Name: defaultOutputName, dataStream: "logs-app-default"}}
+	defer func() { outputs = oldOutputs }()
+
+	line := []byte(`{"log":{"msg":"a"}}`)
+	dec := codec.NewDecoderBytes(nil, &codec.JsonHandle{})
+	first, ok := ParseRecord(dec, line)
+	if !ok {
+		t.Fatal("could not parse the record")
+	}
+	time.Sleep(2 * time.Millisecond)
+	second, ok := ParseRecord(dec, line)
+	if !ok {
+		t.Fatal("could not parse the record")
+	}
+	if first.Document == second.Document {
+		t.Fatalf("expected different @timestamp, got %s twice", first.Document)
+	}
+	if first.ID != second.ID {
+		t.Errorf("expected the same ID, got %q and %q", first.ID, second.ID)
+	}
+}
+
+func TestParseRecordDate(t *testing.T) {
+	defer withIDMode("none", nil)()
+	oldOutputs := outputs
+	defer func() { outputs = oldOutputs }()
+
+	dec := codec.NewDecoderBytes(nil, &codec.JsonHandle{})
+	line := []byte(`{"log":{"msg":"a"}}`)
+
+	outputs = []*Output{{Name: "siem", dataStream: "logs-siem-default"}}
+	rec, ok := ParseRecord(dec, line)
+	if !ok {
+		t.Fatal("expected a record without date to be accepted by a data stream")
+	}
+	if !strings.HasPrefix(rec.Document, `{"@timestamp":`) {
+		t.Errorf("expected @timestamp to be added, got %s", rec.Document)
+	}
+
+	outputs = append(outputs, &Output{Name: defaultOutputName})
+	if _, ok := ParseRecord(dec, line); ok {
+		t.Error("expected a record without date to be rejected by an output with daily indices")
+	}
+}
+
+func TestRecordParserFlushesOnShutdown(t *testing.T) {
+	defer withIDMode("none", nil)()
+	writeC := make(chan []data.Record)
+	oldQueue, oldLines, oldLinesReq, oldReaderDone, oldDone := queue, lines, linesReq, readerDone, done
+	queue, lines, linesReq, readerDone, done = &Queue{WriteC: writeC}, make(chan []byte), make(chan bool), make(chan bool), make(chan bool)
+	defer func() { queue, lines, linesReq, readerDone, done = oldQueue, oldLines, oldLinesReq, oldReaderDone, oldDone }()
+
+	go RecordParser()
+	for _, line := range []string{`{"date":"d","log":{"msg":"a"}}`, `{"date":"d","log":{"msg":"b"}}`} {
+		<-linesReq
+		lines <- []byte(line)
+	}
+	// Let the parser wait for the queue, which is not reading
+	time.Sleep(10 * time.Millisecond)
+	close(done)
+
+	var recs []data.Record
+	for {
+		select {
+		case group := <-writeC:
+			recs = append(recs, group...)
+			continue
+		case <-readerDone:
+		case <-time.After(time.Second):
+			t.Fatal("the parser did not stop")
+		}
+		break
+	}
+	if len(recs) != 2 {
+		t.Errorf("expected the 2 parsed records to be written, got %v", recs)
+	}
+}
@@ -0,0 +1,353 @@
+/*
+bilies-go - Bulk Insert Logs Into ElasticSearch
+Copyright (C) 2016 Adirelle <adirelle@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+/*
+
+Replay
+
+The archives written by the file outputs, or any file in the input format, can be replayed, e.g. to rebuild an
+index after an incident:
+
+	bilies-go replay --from='/var/lib/bilies/archive/archive-*.ndjson.gz' --since=2016.10.01 --url=http://es1:9200/
+
+The archives are read instead of the standard input, whatever their format, compressed or not. The messages go
+through the queue and the outputs as usual, so they keep their IDs and are sent to the same indices. Duplicate
+suppression is disabled, as the replayed messages are expected to have been sent already. With archives of bulk
+requests, the index prefix must be the one used when they were written. bilies-go stops once the archives are
+replayed. The output rate limits apply, see also the rate limiting switches.
+
+The replay opens the queue directory, see --queue-dir, which is locked while bilies-go runs. To replay archives
+while the daemon is running, use another queue directory, e.g. --queue-dir=/var/lib/bilies/replay-queue.
+
+The following switches control the replay:
+
+	--from=FILE [default: none]
+		Archive to replay. Glob patterns are expanded, in the order of the names. This switch can be used multiple
+		times.
+
+	--since=STRING [default: none]
+		Only replay the messages with a "date" greater or equal to this one, e.g. "2016.10.01". The messages
+		without a "date" are not filtered by date.
+
+	--until=STRING [default: none]
+		Only replay the messages with a "date" lower or equal to this one.
+
+	--replay-filter=FIELD==VALUE[|VALUE...] [default: none]
+		Only replay the messages matching the condition. "!=" can also be used. The conditions are written like
+		the ones of the routes. This switch can be used multiple times, all the conditions must match.
+
+	--replay-rate=FLOAT [default: 0]
+		Maximum number of messages read per second (0 for no limit).
+
+	--replay-progress=DURATION [default: 10s]
+		Delay between two progress reports.
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/spf13/pflag"
+
+	"github.com/Adirelle/bilies-go/data"
+)
+
+var (
+	// ErrReplayStopped is returned when bilies-go is stopped during the replay
+	ErrReplayStopped = errors.New("Replay stopped")
+
+	replayMode     bool
+	replayFrom     []string
+	replaySince    string
+	replayUntil    string
+	replayFilters  []string
+	replayRate     float64
+	replayProgress = 10 * time.Second
+
+	replayFiles      []string
+	replayConditions []Condition
+	replayWriter     *io.PipeWriter
+
+	mReplay         = metrics.NewPrefixedChildRegistry(mRoot, "replay.")
+	mReplayRecords  = metrics.GetOrRegisterMeter("records", mReplay)
+	mReplaySkipped  = metrics.GetOrRegisterMeter("skipped.records", mReplay)
+	mReplayErrors   = metrics.GetOrRegisterMeter("errors", mReplay)
+	mReplayProgress = metrics.GetOrRegisterGaugeFloat64("progress", mReplay)
+)
+
+func init() {
+	pflag.StringArrayVar(&replayFrom, "from", replayFrom, "Archive to replay")
+	pflag.StringVar(&replaySince, "since", replaySince, "Only replay the messages with a date greater or equal")
+	pflag.StringVar(&replayUntil, "until", replayUntil, "Only replay the messages with a date lower or equal")
+	pflag.StringArrayVar(&replayFilters, "replay-filter", replayFilters, "Only replay the messages matching the condition")
+	pflag.Float64Var(&replayRate, "replay-rate", replayRate, "Maximum number of messages replayed per second (0 for no limit)")
+	pflag.DurationVar(&replayProgress, "replay-progress", replayProgress, "Delay between progress reports")
+
+	AddBackgroundTask("Replayer", Replayer)
+}
+
+// ParseCommand removes the command, if any, from the arguments.
+func ParseCommand() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		replayMode = true
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+}
+
+// SetupReplay checks the replay switches and replaces the input by the archives.
+func SetupReplay() error {
+	if !replayMode {
+		if len(replayFrom) > 0 {
+			return fmt.Errorf("--from can only be used with the replay command")
+		}
+		return nil
+	}
+	if len(replayFrom) == 0 {
+		return fmt.Errorf("Nothing to replay, use --from")
+	}
+	for _, pattern := range replayFrom {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return err
+		}
+		if len(matches) == 0 {
+			return fmt.Errorf("No archive matches %q", pattern)
+		}
+		sort.Strings(matches)
+		replayFiles = append(replayFiles, matches...)
+	}
+	for _, raw := range replayFilters {
+		c, err := ParseCondition(raw)
+		if err != nil {
+			return err
+		}
+		replayConditions = append(replayConditions, c)
+	}
+	var pipeReader *io.PipeReader
+	pipeReader, replayWriter = io.Pipe()
+	reader = pipeReader
+	return nil
+}
+
+// Replayer writes the messages of the archives into the input.
+func Replayer() {
+	if !replayMode {
+		return
+	}
+	defer replayWriter.Close()
+
+	r := &replay{
+		limiter: &TokenBucket{},
+		last:    time.Now(),
+	}
+	r.limiter.SetRate(replayRate)
+	for _, path := range replayFiles {
+		if info, err := os.Stat(path); err == nil {
+			r.total += info.Size()
+		}
+	}
+	for _, path := range replayFiles {
+		if err := r.replayFile(path); err != nil {
+			if err == io.ErrClosedPipe || err == ErrReplayStopped {
+				return
+			}
+			mReplayErrors.Mark(1)
+			logger.Errorf("Could not replay %q: %s", path, err)
+		}
+		r.offset += r.read
+		r.read = 0
+	}
+	r.report()
+	logger.Noticef("Replay done")
+}
+
+// replay holds the state of the replay.
+type replay struct {
+	limiter *TokenBucket
+	total   int64
+	offset  int64
+	read    int64
+	count   int64
+	skipped int64
+	last    time.Time
+}
+
+// countingReader counts the bytes read from the underlying reader.
+type countingReader struct {
+	io.Reader
+	n *int64
+}
+
+func (c countingReader) Read(p []byte) (n int, err error) {
+	n, err = c.Reader.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return
+}
+
+func (r *replay) replayFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	logger.Noticef("Replaying %q", path)
+
+	var in io.Reader = bufio.NewReader(countingReader{f, &r.read})
+	if magic, _ := in.(*bufio.Reader).Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(in)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		in = gz
+	}
+
+	var (
+		lines  = bufio.NewReader(in)
+		bulk   bool
+		first  = true
+		action map[string]struct {
+			Index string `json:"_index"`
+			ID    string `json:"_id"`
+		}
+	)
+	for {
+		line, err := lines.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		} else if err == io.ErrUnexpectedEOF {
+			// Archive still being written, or truncated
+			logger.Warningf("Unexpected end of %q", path)
+			return nil
+		} else if err != nil && err != io.EOF {
+			return err
+		}
+		if line = bytes.TrimSpace(line); len(line) == 0 {
+			continue
+		}
+		if first {
+			bulk = isBulkAction(line)
+			first = false
+		}
+		if bulk {
+			if action == nil {
+				if err := json.Unmarshal(line, &action); err != nil || len(action) != 1 {
+					return fmt.Errorf("Invalid bulk action: %q", line)
+				}
+				continue
+			}
+			var inRec data.InputRecord
+			for _, a := range action {
+				inRec.ID = a.ID
+				if NeedsDate() {
+					if inRec.Suffix = strings.TrimPrefix(a.Index, indexPrefix+"-"); inRec.Suffix == a.Index {
+						logger.Warningf("Index %q does not match the index prefix %q", a.Index, indexPrefix)
+					}
+				}
+			}
+			action = nil
+			inRec.Document = json.RawMessage(line)
+			if line, err = json.Marshal(inRec); err != nil {
+				return err
+			}
+		}
+		if err := r.replayLine(line); err != nil {
+			return err
+		}
+	}
+}
+
+// replayLine writes the line into the input, unless filtered.
+func (r *replay) replayLine(line []byte) error {
+	if !r.accepts(line) {
+		r.skipped++
+		mReplaySkipped.Mark(1)
+	} else {
+		if wait := r.limiter.Take(1, time.Now()); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-done:
+				return ErrReplayStopped
+			}
+		}
+		if _, err := replayWriter.Write(append(line, '\n')); err != nil {
+			return err
+		}
+		r.count++
+		mReplayRecords.Mark(1)
+	}
+	if replayProgress > 0 && time.Since(r.last) >= replayProgress {
+		r.report()
+	}
+	return nil
+}
+
+// accepts tells whether the message passes the filters.
+func (r *replay) accepts(line []byte) bool {
+	fields := NewFields(line)
+	if replaySince != "" || replayUntil != "" {
+		if date, found := fields.GetString("date"); found && date != "" {
+			if (replaySince != "" && date < replaySince) || (replayUntil != "" && date > replayUntil) {
+				return false
+			}
+		}
+	}
+	for _, c := range replayConditions {
+		if !c.Matches(fields) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *replay) report() {
+	r.last = time.Now()
+	progress := 100.0
+	if r.total > 0 {
+		progress = float64(r.offset+atomic.LoadInt64(&r.read)) * 100 / float64(r.total)
+	}
+	mReplayProgress.Update(progress)
+	logger.Noticef("Replayed %d message(s), skipped %d, %.1f%% of the archives read", r.count, r.skipped, progress)
+}
+
+// isBulkAction tells whether the line is the action of a bulk request, e.g. {"index":{...}}.
+func isBulkAction(line []byte) bool {
+	var object map[string]json.RawMessage
+	if json.Unmarshal(line, &object) != nil || len(object) != 1 {
+		return false
+	}
+	for _, name := range []string{"index", "create"} {
+		if _, found := object[name]; found {
+			return true
+		}
+	}
+	return false
+}
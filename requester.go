@@ -20,16 +20,23 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 
 Requests
 
-bilies-go retries the requests indefinitively on network or 5xx errors. In case of 400 error, batchs are split
-in smaller parts and send independently to find the culprit.
+bilies-go retries the requests on network, 429 or 5xx errors, indefinitively unless a retry budget is set. The records
+of a bulk request rejected individually with a 429 status are sent again after a backoff delay. Batchs that
+cannot be sent within the budget are moved to the dead letters. In case of 400 error, batchs are split in smaller
+parts and send independently to find the culprit. Batchs are also split on 413 errors (request too large). The
+other APIs have their own rules, see the API switches.
 
 The following switchs control requests:
 
+	--url=STRING [default: none]
+		URL of an ElasticSearch server, e.g. "https://es1:9243/prefix/". This switch can be used multiple times
+		to add more servers. If used, --host, --protocol and --port are ignored. See also --output.
+
 	-h --host=STRING [default: localhost]
 		Hostname of a ElasticSearch servers. This switch can be used multiple times to add more severs.
 
 	-P --protocol=(http|https) [default: http]
-		Protocol to of the ElasticSearch servers.
+		Protocol to of the ElasticSearch servers. See also the TLS switches.
 
 	-p --port=INT [default: 9200]
 		Port of the ElasticSearch servers.
@@ -37,8 +44,18 @@ The following switchs control requests:
 	-u --user=STRING [default: none]
 		Username for basic authentification.
 
-	-w --passwd=STRING [default: none]
-		Password for basic authentification.
+	-w --passwd=STRING [default: $BILIES_PASSWD]
+		Password for basic authentification. See also the authentication switches.
+
+	--retry-budget=DURATION [default: 0]
+		Maximum time spent sending a batch, retries included (0 for no limit).
+
+	-H --header="NAME: VALUE" [default: none]
+		Add a header to all the requests, e.g. "X-Tenant: foo". This switch can be used multiple times.
+
+	--opaque-id=STRING [default: bilies-HOSTNAME-PID]
+		Identifier of the instance. The bulk requests carry a "X-Opaque-Id: ID/BATCH" header, so they can be
+		traced in the tasks and the slow logs of ElasticSearch. Use an empty string to disable it.
 */
 package main
 
@@ -48,7 +65,10 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/rcrowley/go-metrics"
 	"github.com/spf13/pflag"
@@ -58,135 +78,365 @@ import (
 )
 
 var (
+	backendRawURLs []string
+
 	hosts    = []string{"localhost"}
 	protocol = "http"
 	port     = 9200
-	username string
-	password string
-
-	client      = http.Client{}
-	backendURLs BackendURLPool
-
-	mRequester     = metrics.NewPrefixedChildRegistry(mRoot, "requests.")
-	mRequestSize   = metrics.NewRegisteredHistogram("size", mRequester, NewSample())
-	mRequestTries  = metrics.NewRegisteredHistogram("tries", mRequester, NewSample())
-	mRequestTime   = metrics.NewRegisteredTimer("time", mRequester)
-	mRequestBytes  = metrics.NewRegisteredMeter("bytes", mRequester)
-	mRequestCount  = metrics.NewRegisteredMeter("count", mRequester)
-	mRequestErrors = metrics.NewRegisteredMeter("errors", mRequester)
-	mRequestStatus = metrics.NewPrefixedChildRegistry(mRequester, "status.")
+
+	retryBudget time.Duration
+
+	rawHeaders    []string
+	customHeaders = http.Header{}
+	opaqueID      string
+
+	// ErrRetryBudgetExceeded is returned when a batch could not be sent within the retry budget
+	ErrRetryBudgetExceeded = errors.New("Retry budget exceeded")
+
+	transport = &ReloadableTransport{}
+	client    = http.Client{Transport: transport}
+
+	mRequester      = metrics.NewPrefixedChildRegistry(mRoot, "requests.")
+	mRequestSize    = metrics.NewRegisteredHistogram("size", mRequester, NewSample())
+	mRequestTries   = metrics.NewRegisteredHistogram("tries", mRequester, NewSample())
+	mRequestTime    = metrics.NewRegisteredTimer("time", mRequester)
+	mRequestBytes   = metrics.NewRegisteredMeter("bytes", mRequester)
+	mRequestCount   = metrics.NewRegisteredMeter("count", mRequester)
+	mRequestErrors  = metrics.NewRegisteredMeter("errors", mRequester)
+	mRequestExpired = metrics.NewRegisteredMeter("expired", mRequester)
+	mRequestResent  = metrics.NewRegisteredMeter("resent", mRequester)
+	mRequestStatus  = metrics.NewPrefixedChildRegistry(mRequester, "status.")
 )
 
 func init() {
+	pflag.StringArrayVar(&backendRawURLs, "url", backendRawURLs, "URL of ElasticSearch server")
 	pflag.StringSliceVarP(&hosts, "host", "h", hosts, "Hostname of ElasticSearch server")
 	pflag.StringVarP(&protocol, "protocol", "P", protocol, "Protocol : http | https")
 	pflag.IntVarP(&port, "port", "p", port, "ElasticSearch port")
-	pflag.StringVarP(&username, "user", "u", username, "Username for authentication")
-	pflag.StringVarP(&password, "passwd", "w", password, "Password for authentication")
+	pflag.DurationVar(&retryBudget, "retry-budget", retryBudget, "Maximum time spent sending a batch (0 for no limit)")
+	pflag.StringArrayVarP(&rawHeaders, "header", "H", rawHeaders, "Header added to the requests, as \"Name: value\"")
 
-	AddTask("Requester", Requester)
+	hostname, _ := os.Hostname()
+	opaqueID = fmt.Sprintf("bilies-%s-%d", hostname, os.Getpid())
+	pflag.StringVar(&opaqueID, "opaque-id", opaqueID, "Identifier of the instance in the X-Opaque-Id header")
+
+	AddProtocol("elasticsearch", ElasticsearchProtocol{})
 }
 
-func Requester() {
-	backendURLs = NewBackendURLPool(hosts, protocol, port)
-	for buf := range batchs {
-		SendSlice(&buf, 0, buf.Count())
+// SetupRequests applies the settings shared by all the outputs.
+func SetupRequests() {
+	var err error
+	if err = transport.Reload(); err != nil {
+		logger.Fatalf("Invalid transport configuration: %s", err)
+	}
+	client.Timeout = requestTimeout
+	for _, o := range outputs {
+		if o.dataStream != "" && o.writeAlias != "" {
+			logger.Fatalf("--data-stream and --write-alias cannot be used together, in output %s", o)
+		}
+	}
+	for _, raw := range rawHeaders {
+		parts := strings.SplitN(raw, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			logger.Fatalf("Invalid header %q, expected \"Name: value\"", raw)
+		}
+		customHeaders.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	for _, o := range outputs {
+		if o.IsFile() {
+			continue
+		}
+		if o.protocol, err = GetProtocol(o.api); err == nil {
+			err = o.protocol.Check(o)
+		}
+		if err != nil {
+			logger.Fatalf("Invalid output %s: %s", o, err)
+		}
+		if o.awsSigV4 {
+			if o.signer, err = NewAWSSigner(o.awsRegion, o.awsService); err != nil {
+				logger.Fatalf("Cannot sign the requests of %s: %s", o, err)
+			}
+		}
+	}
+	for _, c := range AllCredentials() {
+		if err = c.Load(); err != nil {
+			logger.Fatalf("Could not read credentials: %s", err)
+		}
+	}
+	if err = LoadRateLimits(); err != nil {
+		logger.Fatalf("Could not read rate limits: %s", err)
+	}
+	SetupBootstrap()
+}
+
+// Requester sends the batchs of the output.
+func (o *Output) Requester() {
+	var err error
+	registry := metrics.NewPrefixedChildRegistry(o.metrics, "pool.")
+	if o.pool, err = NewBackendURLPool(o.URLs, o.credentials, o.signer, o.healthCheckPath, o.sniff, registry); err != nil {
+		logger.Fatalf("Invalid backend of %s: %s", o, err)
+	}
+	o.protocol.Start(o)
+
+	for buf := range o.batchs {
+		var deadline time.Time
+		if retryBudget > 0 {
+			deadline = time.Now().Add(retryBudget)
+		}
+		o.SendSlice(&buf, 0, buf.Count(), deadline)
 	}
 }
 
-func SendSlice(buf *IndexedBuffer, i, j int) (err error) {
+func (o *Output) SendSlice(buf *IndexedBuffer, i, j int, deadline time.Time) (err error) {
 	if i == j {
 		return
 	}
-	logger.Debugf("Sending slice [%d:%d]", i, j)
-	err = Send(buf, i, j)
+	logger.Debugf("Sending slice [%d:%d] to %s", i, j, o)
+	overloaded, err := o.Send(buf, i, j, deadline)
 	if err == nil {
-		logger.Debugf("Successfully sent slice [%d:%d]", i, j)
-		AckRecords(j - i)
-		return
+		logger.Debugf("Successfully sent slice [%d:%d] to %s", i, j, o)
+		if len(overloaded) == 0 {
+			o.AckRecords(buf.QueueKeys(i, j))
+			return
+		}
+		o.AckRecords(buf.QueueKeysExcept(i, j, overloaded))
+		return o.Resend(buf, overloaded, deadline)
 	}
-	if e, ok := err.(HTTPError); !ok || e.StatusCode != 400 {
+	if err == ErrRetryBudgetExceeded {
+		mRequestExpired.Mark(1)
+		DeadLetter(fmt.Sprintf("not sent to %s within %s", o, retryBudget), buf.Records(i, j)...)
+		o.AckRecords(buf.QueueKeys(i, j))
+		return nil
+	}
+	if !o.protocol.IsRejection(err) {
 		logger.Errorf("Permanent error: %s", err)
 		return
 	}
 	if j-i == 1 {
 		logger.Errorf("Action rejected:\n%s", buf.Slice(i, j))
-		AckRecords(1)
+		o.AckRecords(buf.QueueKeys(i, j))
 		return
 	}
 
 	h := (i + j) / 2
 	logger.Debugf("Sending subslices [%d:%d] & [%d:%d]", i, h, h, j)
-	if err = SendSlice(buf, i, h); err != nil {
+	if err = o.SendSlice(buf, i, h, deadline); err != nil {
 		return
 	}
-	return SendSlice(buf, h, j)
+	return o.SendSlice(buf, h, j, deadline)
 }
 
-func AckRecords(n int) {
-	logger.Debugf("Acking %d records", n)
-	queue.DropC <- n
+// Resend sends again the records at the given positions, which the server rejected because it was overloaded, after
+// a backoff delay.
+func (o *Output) Resend(buf *IndexedBuffer, positions []int, deadline time.Time) error {
+	retry := buf.Subset(positions)
+	delay := BackoffDelay(retry.retries, 0)
+	mRequestResent.Mark(int64(retry.Count()))
+	logger.Warningf("%s rejected %d record(s) of batch %s because it is overloaded, sending them again in %s", o, retry.Count(), buf.ID, delay)
+
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		expired = t.C
+	}
+	select {
+	case <-time.After(delay):
+	case <-expired:
+		mRequestExpired.Mark(1)
+		DeadLetter(fmt.Sprintf("not sent to %s within %s", o, retryBudget), retry.Records(0, retry.Count())...)
+		o.AckRecords(retry.QueueKeys(0, retry.Count()))
+		return nil
+	case <-done:
+		return errors.New("Shutting down")
+	}
+	return o.SendSlice(&retry, 0, retry.Count(), deadline)
 }
 
-func Send(buf *IndexedBuffer, i, j int) (err error) {
-	var body = buf.Slice(i, j)
-	for tries := 1; ; tries++ {
+func (o *Output) AckRecords(keys []DbKey) {
+	logger.Debugf("Acking %d records", len(keys))
+	o.cursor.Ack(keys)
+}
+
+// Send sends the records between i and j, retrying on backend errors until the deadline, if not zero. It returns the
+// positions of the records that the server rejected because it is overloaded.
+func (o *Output) Send(buf *IndexedBuffer, i, j int, deadline time.Time) (overloaded []int, err error) {
+	body, header, err := o.protocol.Request(o, buf, i, j)
+	if err != nil {
+		return
+	}
+	// The rate limits apply to the requests as sent, and the wait does not count against the retry budget
+	waitStart := time.Now()
+	if !o.WaitForRateLimits(j-i, len(body)) {
+		return nil, errors.New("Shutting down")
+	}
+	if !deadline.IsZero() {
+		deadline = deadline.Add(time.Since(waitStart))
+	}
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		expired = t.C
+	}
+	for tries := 1; ; {
+		var (
+			backends <-chan *BackendURL
+			probe    <-chan time.Time
+		)
+		if wait, ok := o.breaker.Allow(time.Now()); ok {
+			backends = o.pool.Get()
+		} else {
+			probe = time.After(wait)
+		}
+
 		select {
-		case url := <-backendURLs.Get():
-			var resp *data.ESResponse
-			resp, err = SendTo(url.String(), body)
-			if err == nil || !IsBackendError(err) {
+		case url := <-backends:
+			var result interface{}
+			start := time.Now()
+			result, err = SendTo(o.protocol, o.protocol.URL(o, url), url, body, header)
+			elapsed := time.Since(start)
+			if err == nil || !o.protocol.IsBackendError(err) {
+				o.breaker.Success()
+				overloaded = o.protocol.Report(o, buf, i, result)
+				e, ok := err.(HTTPError)
+				o.AdjustBatchLimit(j-i, elapsed, len(overloaded) > 0 || (ok && e.StatusCode == http.StatusRequestEntityTooLarge))
 				mRequestTries.Update(int64(tries))
-				url.Release(false)
+				url.Release(elapsed, nil)
 				if err == nil {
 					logger.Debugf("Successfully sent %d bytes to %s", len(body), url)
 				} else {
 					logger.Errorf("%s replied with an error, bailing out. Cause: %s", url, err)
 				}
-				ReportItemFailures(buf, resp)
 				return
 			}
-			url.Release(true)
+			o.breaker.Failure(time.Now())
+			url.Release(elapsed, err)
 			logger.Errorf("%s is failing, trying another backend: Cause: %s", url, err)
+			tries++
+		case <-probe:
+		case <-expired:
+			logger.Errorf("Could not send slice [%d:%d] of batch %s to %s within %s", i, j, buf.ID, o, retryBudget)
+			return nil, ErrRetryBudgetExceeded
 		case <-done:
-			return errors.New("Shutting down")
+			return nil, errors.New("Shutting down")
+		}
+	}
+}
+
+// ElasticsearchProtocol sends the batchs using the bulk API of ElasticSearch.
+type ElasticsearchProtocol struct{}
+
+func (ElasticsearchProtocol) Check(o *Output) error {
+	return nil
+}
+
+// Start bootstraps the cluster and starts the rollover requests.
+func (ElasticsearchProtocol) Start(o *Output) {
+	if err := o.Bootstrap(); err != nil {
+		if bootstrapErrors == "warn" {
+			logger.Warningf("Could not bootstrap the cluster of %s: %s", o, err)
+		} else {
+			logger.Fatalf("Could not bootstrap the cluster of %s: %s", o, err)
 		}
 	}
+	go o.Rollover()
+}
+
+func (ElasticsearchProtocol) URL(o *Output, u *BackendURL) string {
+	return u.URL("_bulk")
 }
 
-func ReportItemFailures(buf *IndexedBuffer, resp *data.ESResponse) {
-	if resp.Items == nil {
+func (ElasticsearchProtocol) Request(o *Output, buf *IndexedBuffer, i, j int) ([]byte, http.Header, error) {
+	header := http.Header{"Expect": {"100-continue"}}
+	if opaqueID != "" {
+		header.Set("X-Opaque-Id", fmt.Sprintf("%s/%s", opaqueID, buf.ID))
+	}
+	return buf.Slice(i, j), header, nil
+}
+
+func (ElasticsearchProtocol) Response(resp *http.Response) (result interface{}, err error) {
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		logger.Warningf("Unsupported content-type: %q", resp.Header.Get("Content-Type"))
+		return
+	}
+	var esResp *data.ESResponse
+	if err = codec.NewDecoder(resp.Body, &codec.JsonHandle{}).Decode(&esResp); err != nil {
+		logger.Errorf("Could not parse response: %s", err)
+		return
+	}
+	return esResp, esResp.ToError()
+}
+
+// Report logs the rejected items, counts the indexed documents and returns the items rejected because the cluster is
+// overloaded.
+func (ElasticsearchProtocol) Report(o *Output, buf *IndexedBuffer, i int, result interface{}) []int {
+	resp, _ := result.(*data.ESResponse)
+	ReportItemFailures(buf, i, resp)
+	o.CountIndexedDocuments(resp)
+	return OverloadedItems(buf, i, resp)
+}
+
+func (ElasticsearchProtocol) IsBackendError(err error) bool {
+	return IsBackendError(err)
+}
+
+func (ElasticsearchProtocol) IsRejection(err error) bool {
+	e, ok := err.(HTTPError)
+	return ok && (e.StatusCode == http.StatusBadRequest || e.StatusCode == http.StatusRequestEntityTooLarge)
+}
+
+func ReportItemFailures(buf *IndexedBuffer, i int, resp *data.ESResponse) {
+	if resp == nil || resp.Items == nil {
 		return
 	}
-	for _, r := range resp.Items {
+	for k, r := range resp.Items {
 		s := r.Status()
-		if s == nil {
+		if s == nil || s.Status == http.StatusTooManyRequests {
+			// The items rejected because the cluster is overloaded are sent again
 			continue
 		}
 		if err := s.ToError(); err != nil {
-			b, _ := buf.GetByKey(s.ID)
+			b, lookupErr := buf.GetByKey(s.ID)
+			if lookupErr != nil && i+k < buf.Count() {
+				// Generated IDs are unknown, rely on the order of items
+				b = buf.Slice(i+k, i+k+1)
+			}
 			logger.Warningf("Error: %s, ID: %s, Data:\n%s", err, s.ID, b)
 		}
 	}
 }
 
-func SendTo(url string, body []byte) (esResp *data.ESResponse, err error) {
+// OverloadedItems returns the positions of the records rejected because the cluster is overloaded, given that the
+// items of the response are in the order of the records, starting at i.
+func OverloadedItems(buf *IndexedBuffer, i int, resp *data.ESResponse) (positions []int) {
+	if resp == nil {
+		return
+	}
+	for k, r := range resp.Items {
+		if s := r.Status(); s != nil && s.Status == http.StatusTooManyRequests && i+k < buf.Count() {
+			positions = append(positions, i+k)
+		}
+	}
+	return
+}
+
+// SendTo posts the body to the target URL of the backend, and reads the response using the protocol.
+func SendTo(protocol Protocol, target string, backend *BackendURL, body []byte, header http.Header) (result interface{}, err error) {
 	var (
 		req  *http.Request
 		resp *http.Response
 	)
-	logger.Debugf("Sending %d bytes to %s:", len(body), url)
-	req, err = http.NewRequest("POST", url, bytes.NewReader(body))
+	logger.Debugf("Sending %d bytes to %s:", len(body), backend)
+	req, err = backend.newRequest("POST", target, body, header)
 	if err != nil {
 		return
 	}
-	req.Header.Add("Expect", "100-continue")
-	req.Header.Add("Accept", "application/json")
-	if username != "" {
-		req.SetBasicAuth(username, password)
-	}
 
-	mRequestTime.Time(func() { resp, err = client.Do(req) })
+	start := time.Now()
+	resp, err = client.Do(req)
+	mRequestTime.UpdateSince(start)
+	backend.mTime.UpdateSince(start)
 	if err == nil {
 		mRequestCount.Mark(1)
 		mRequestSize.Update(int64(len(body)))
@@ -195,18 +445,14 @@ func SendTo(url string, body []byte) (esResp *data.ESResponse, err error) {
 	}
 	if resp != nil {
 		defer resp.Body.Close()
-		if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
-			if err = codec.NewDecoder(resp.Body, &codec.JsonHandle{}).Decode(&esResp); err != nil {
-				logger.Errorf("Could not parse response: %s", err)
-			} else {
-				err = esResp.ToError()
-			}
-		} else {
-			logger.Warningf("Unsupported content-type: %q", resp.Header.Get("Content-Type"))
-		}
+		result, err = protocol.Response(resp)
 	}
-	if err == nil {
-		err = NewHTTPError(resp)
+	if resp != nil {
+		if e, ok := NewHTTPError(resp).(HTTPError); ok {
+			// The HTTP status prevails over the error reported in the body, if any
+			e.Cause = err
+			err = e
+		}
 	}
 	if err != nil {
 		mRequestErrors.Mark(1)
@@ -214,10 +460,58 @@ func SendTo(url string, body []byte) (esResp *data.ESResponse, err error) {
 	return
 }
 
+// NewRequest creates an authenticated request to an endpoint of the backend.
+func (u *BackendURL) NewRequest(method string, endpoint string, body []byte, header http.Header) (*http.Request, error) {
+	return u.newRequest(method, u.URL(endpoint), body, header)
+}
+
+// newRequest creates an authenticated request to an URL of the backend.
+func (u *BackendURL) newRequest(method string, target string, body []byte, header http.Header) (req *http.Request, err error) {
+	req, err = http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	// The values are copied, so the signing or the authentication cannot alter the shared headers
+	for name, values := range customHeaders {
+		req.Header[name] = append([]string(nil), values...)
+	}
+	for name, values := range header {
+		req.Header[name] = append([]string(nil), values...)
+	}
+	req.Header.Add("Accept", "application/json")
+	u.pool.credentials.Apply(req)
+	u.Authenticate(req)
+	if u.pool.signer != nil {
+		err = u.pool.signer.Sign(req, body, time.Now())
+	}
+	return
+}
+
+// Do sends a management request to the backend and decodes the JSON response into result, if not nil.
+func (u *BackendURL) Do(method string, endpoint string, body []byte, result interface{}) error {
+	req, err := u.NewRequest(method, endpoint, body, http.Header{"Content-Type": {"application/json"}})
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err = NewHTTPError(resp); err != nil {
+		return err
+	}
+	if result == nil {
+		return nil
+	}
+	return codec.NewDecoder(resp.Body, &codec.JsonHandle{}).Decode(result)
+}
+
+// IsBackendError tells whether an ElasticSearch request should be retried with another backend.
 func IsBackendError(err error) (is bool) {
 	switch e := err.(type) {
 	case HTTPError:
-		is = e.StatusCode >= 500
+		is = e.Temporary()
 	case *url.Error:
 		is = true
 	default:
@@ -230,6 +524,8 @@ type HTTPError struct {
 	Status     string
 	StatusCode int
 	Req        string
+	RetryAfter time.Duration
+	Cause      error
 }
 
 func NewHTTPError(rep *http.Response) error {
@@ -238,17 +534,35 @@ func NewHTTPError(rep *http.Response) error {
 			Status:     rep.Status,
 			StatusCode: rep.StatusCode,
 			Req:        fmt.Sprintf("%s %s", rep.Request.Method, rep.Request.URL.String()),
+			RetryAfter: ParseRetryAfter(rep.Header.Get("Retry-After"), time.Now()),
 		}
 	}
 	return nil
 }
 
+// ParseRetryAfter parses the value of a Retry-After header, either a number of seconds or a date.
+func ParseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
+
 func (e HTTPError) Error() string {
+	if e.Cause != nil {
+		return fmt.Sprintf("%s: %s (%s)", e.Req, e.Status, e.Cause)
+	}
 	return fmt.Sprintf("%s: %s", e.Req, e.Status)
 }
 
 func (e HTTPError) Temporary() bool {
-	return e.StatusCode >= 500
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
 }
 
 func (e HTTPError) Timeout() bool {
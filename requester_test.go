@@ -0,0 +1,183 @@
+/*
+bilies-go - Bulk Insert Logs Into ElasticSearch
+Copyright (C) 2016 Adirelle <adirelle@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Adirelle/bilies-go/data"
+	"github.com/rcrowley/go-metrics"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2016, 10, 1, 12, 0, 0, 0, time.UTC)
+	for value, expected := range map[string]time.Duration{
+		"":     0,
+		"120":  2 * time.Minute,
+		"0":    0,
+		"-5":   0,
+		"soon": 0,
+		"1.5":  0,
+		now.Add(30 * time.Second).Format(http.TimeFormat): 30 * time.Second,
+		now.Add(-time.Minute).Format(http.TimeFormat):     0,
+	} {
+		if got := ParseRetryAfter(value, now); got != expected {
+			t.Errorf("%q: expected %s, got %s", value, expected, got)
+		}
+	}
+}
+
+// bulkBuffer returns a buffer holding a bulk request for records with the given IDs.
+func bulkBuffer(recs ...data.Record) IndexedBuffer {
+	buf := MakeIndexedBuffer(len(recs))
+	buf.ID = "1"
+	for _, rec := range recs {
+		fmt.Fprintf(&buf, `{"index":{"_id":%q}}`+"\n%s\n", rec.ID, rec.Document)
+		buf.Mark(rec)
+	}
+	return buf
+}
+
+func TestOverloadedItems(t *testing.T) {
+	buf := bulkBuffer(data.Record{ID: "a"}, data.Record{ID: "b"}, data.Record{ID: "c"}, data.Record{ID: "d"})
+	item := func(status int) data.ESItemResponse {
+		return data.ESItemResponse{Index: &data.ESOpStatus{ESStatus: data.ESStatus{Status: status}}}
+	}
+	resp := &data.ESResponse{Items: []data.ESItemResponse{item(201), item(429), item(400), item(429)}}
+	if got := OverloadedItems(&buf, 0, resp); fmt.Sprint(got) != "[1 3]" {
+		t.Errorf("expected [1 3], got %v", got)
+	}
+	// The response of a slice
+	resp.Items = resp.Items[:3]
+	if got := OverloadedItems(&buf, 1, resp); fmt.Sprint(got) != "[2]" {
+		t.Errorf("expected [2], got %v", got)
+	}
+	if got := OverloadedItems(&buf, 0, nil); got != nil {
+		t.Errorf("expected nothing, got %v", got)
+	}
+}
+
+func TestSendSliceResendsOverloadedItems(t *testing.T) {
+	defer withBackoff("none")()
+
+	var (
+		mu     sync.Mutex
+		bodies []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		first := len(bodies) == 1
+		mu.Unlock()
+		// The first request has its second item rejected because the cluster is overloaded
+		var items []string
+		for n := bytes.Count(body, []byte("\n")) / 2; n > 0; n-- {
+			status := 201
+			if first && len(items) == 1 {
+				status = 429
+			}
+			items = append(items, fmt.Sprintf(`{"index":{"status":%d}}`, status))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"took":1,"errors":%v,"items":[%s]}`, first, strings.Join(items, ","))
+	}))
+	defer server.Close()
+
+	q := openTestQueue(t, t.TempDir(), defaultOutputName)
+	writeTestRecords(q, data.NormalPriority, "a", "b", "c")
+	recs := make([]data.Record, 3)
+	for i := range recs {
+		recs[i] = <-q.Cursor(defaultOutputName).ReadC
+		recs[i].Document = fmt.Sprintf(`{"n":%d}`, i)
+	}
+
+	o := NewOutput("test", []string{server.URL})
+	o.protocol = ElasticsearchProtocol{}
+	o.cursor = q.Cursor(defaultOutputName)
+	var err error
+	if o.pool, err = NewBackendURLPool(o.URLs, &Credentials{}, nil, "/", false, metrics.NewRegistry()); err != nil {
+		t.Fatal(err)
+	}
+	if err := transport.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := bulkBuffer(recs...)
+	if err := o.SendSlice(&buf, 0, buf.Count(), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(bodies) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(bodies))
+	}
+	if expected := string(buf.Slice(1, 2)); bodies[1] != expected {
+		t.Errorf("expected the rejected record to be sent again, got %q", bodies[1])
+	}
+	// All the records are eventually acked
+	deadline := time.Now().Add(5 * time.Second)
+	for countRecords(q) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the records to be acked, %d remain", countRecords(q))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNewRequestCopiesHeaders(t *testing.T) {
+	oldHeaders := customHeaders
+	defer func() { customHeaders = oldHeaders }()
+	customHeaders = http.Header{"X-Tenant": {"foo"}}
+
+	u, err := ParseBackendURL("http://localhost:9200")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.pool = &BackendURLPool{credentials: &Credentials{}}
+	header := http.Header{"Content-Type": {"application/json"}}
+	req1, err := u.NewRequest("GET", "_cluster/health", nil, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req2, err := u.NewRequest("GET", "_cluster/health", nil, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req1.Header.Add("X-Tenant", "bar")
+	req1.Header["Content-Type"][0] = "text/plain"
+	req1.Header["X-Tenant"][0] = "baz"
+	for _, h := range []http.Header{req2.Header, customHeaders} {
+		if v := h["X-Tenant"]; len(v) != 1 || v[0] != "foo" {
+			t.Errorf("expected the custom header to be unchanged, got %q", v)
+		}
+	}
+	for _, h := range []http.Header{req2.Header, header} {
+		if v := h.Get("Content-Type"); v != "application/json" {
+			t.Errorf("expected the request header to be unchanged, got %q", v)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+/*
+bilies-go - Bulk Insert Logs Into ElasticSearch
+Copyright (C) 2016 Adirelle <adirelle@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+/*
+
+Routing
+
+By default, all the messages are sent to all the outputs. Routes send the messages to some of the outputs, depending
+on their fields. The routes are evaluated in order when the messages are read, and the first matching route
+applies. A route is written "CONDITION:OUTPUT[,OUTPUT...]", where the condition is either "FIELD==VALUE" or
+"FIELD!=VALUE". Field names are dot-separated paths into the input message, and several values can be separated by
+"|". For example:
+
+	--route='log.level==audit|security:siem' --route-default=main
+
+The following switches control the routing:
+
+	--route=CONDITION:OUTPUT[,OUTPUT...] [default: none]
+		Send the messages matching the condition to the outputs. This switch can be used multiple times.
+
+	--route-default=OUTPUT,... [default: all outputs]
+		The outputs of the messages matching no route. Use "none" to drop them.
+*/
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/spf13/pflag"
+)
+
+var (
+	rawRoutes    []string
+	routeDefault []string
+
+	routes       []Route
+	defaultRoute []string
+
+	mRouting        = metrics.NewPrefixedChildRegistry(mRoot, "routing.")
+	mRoutingDropped = metrics.GetOrRegisterMeter("dropped.records", mRouting)
+)
+
+func init() {
+	pflag.StringArrayVar(&rawRoutes, "route", rawRoutes, "Route, as CONDITION:OUTPUT[,OUTPUT...]")
+	pflag.StringSliceVar(&routeDefault, "route-default", routeDefault, "Outputs of the messages matching no route")
+}
+
+// Condition tests a field of the messages.
+type Condition struct {
+	Field  string
+	Values []string
+	Negate bool
+}
+
+// Route sends the messages matching a condition to some outputs.
+type Route struct {
+	Condition
+	Outputs []string
+}
+
+// ParseRoute parses a route, as CONDITION:OUTPUT[,OUTPUT...].
+func ParseRoute(raw string) (r Route, err error) {
+	i := strings.LastIndex(raw, ":")
+	if i < 0 {
+		return r, fmt.Errorf("Invalid route %q, expected CONDITION:OUTPUT[,OUTPUT...]", raw)
+	}
+	if r.Outputs, err = parseOutputList(raw[i+1:]); err != nil {
+		return
+	}
+	r.Condition, err = ParseCondition(raw[:i])
+	return
+}
+
+// ParseCondition parses a condition, as FIELD==VALUE[|VALUE...] or FIELD!=VALUE[|VALUE...].
+func ParseCondition(raw string) (c Condition, err error) {
+	op := "=="
+	i := strings.Index(raw, op)
+	if j := strings.Index(raw, "!="); j >= 0 && (i < 0 || j < i) {
+		op, i, c.Negate = "!=", j, true
+	}
+	if i < 0 {
+		return c, fmt.Errorf("Invalid condition %q, expected FIELD==VALUE or FIELD!=VALUE", raw)
+	}
+	if c.Field = strings.TrimSpace(raw[:i]); c.Field == "" {
+		return c, fmt.Errorf("Missing field in condition %q", raw)
+	}
+	for _, v := range strings.Split(raw[i+len(op):], "|") {
+		c.Values = append(c.Values, strings.TrimSpace(v))
+	}
+	return
+}
+
+// Matches tells whether the message matches the condition.
+func (c Condition) Matches(fields *Fields) bool {
+	v, found := fields.GetString(c.Field)
+	matched := false
+	if found {
+		for _, value := range c.Values {
+			if v == value {
+				matched = true
+				break
+			}
+		}
+	}
+	return matched != c.Negate
+}
+
+// SetupRoutes parses the routing switches.
+func SetupRoutes() error {
+	for _, raw := range rawRoutes {
+		r, err := ParseRoute(raw)
+		if err != nil {
+			return err
+		}
+		routes = append(routes, r)
+	}
+	if len(routeDefault) == 1 && routeDefault[0] == "none" {
+		defaultRoute = []string{}
+	} else if len(routeDefault) > 0 {
+		var err error
+		if defaultRoute, err = parseOutputList(strings.Join(routeDefault, ",")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RouteRecord returns the outputs of a message, or nil for all the outputs.
+func RouteRecord(fields *Fields) []string {
+	for _, r := range routes {
+		if r.Matches(fields) {
+			return r.Outputs
+		}
+	}
+	return defaultRoute
+}
+
+// parseOutputList parses a comma-separated list of known outputs.
+func parseOutputList(raw string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for _, o := range outputs {
+			found = found || o.Name == name
+		}
+		if !found {
+			return nil, fmt.Errorf("Unknown output %q", name)
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("No output in %q", raw)
+	}
+	return names, nil
+}
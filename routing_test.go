@@ -0,0 +1,111 @@
+/*
+bilies-go - Bulk Insert Logs Into ElasticSearch
+Copyright (C) 2016 Adirelle <adirelle@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func withOutputs(names ...string) func() {
+	oldOutputs, oldRoutes, oldDefault := outputs, routes, defaultRoute
+	oldRawRoutes, oldRouteDefault := rawRoutes, routeDefault
+	outputs = nil
+	for _, name := range names {
+		outputs = append(outputs, &Output{Name: name})
+	}
+	routes, defaultRoute = nil, nil
+	return func() {
+		outputs, routes, defaultRoute = oldOutputs, oldRoutes, oldDefault
+		rawRoutes, routeDefault = oldRawRoutes, oldRouteDefault
+	}
+}
+
+func TestParseRoute(t *testing.T) {
+	defer withOutputs("main", "siem", "archive")()
+
+	for raw, expected := range map[string]Route{
+		"log.level==audit:siem": {
+			Condition{Field: "log.level", Values: []string{"audit"}}, []string{"siem"},
+		},
+		" log.level == audit | security : siem, archive": {
+			Condition{Field: "log.level", Values: []string{"audit", "security"}}, []string{"siem", "archive"},
+		},
+		"log.app!=web:main": {
+			Condition{Field: "log.app", Values: []string{"web"}, Negate: true}, []string{"main"},
+		},
+		"log.url==http://host/a!=b:main": {
+			Condition{Field: "log.url", Values: []string{"http://host/a!=b"}}, []string{"main"},
+		},
+		"log.empty==:main": {
+			Condition{Field: "log.empty", Values: []string{""}}, []string{"main"},
+		},
+	} {
+		r, err := ParseRoute(raw)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", raw, err)
+		} else if !reflect.DeepEqual(r, expected) {
+			t.Errorf("%q: expected %+v, got %+v", raw, expected, r)
+		}
+	}
+}
+
+func TestParseRouteErrors(t *testing.T) {
+	defer withOutputs("main", "siem")()
+
+	for _, raw := range []string{
+		"log.level==audit",
+		"log.level==audit:",
+		"log.level==audit:other",
+		"log.level:siem",
+		"==audit:siem",
+	} {
+		if _, err := ParseRoute(raw); err == nil {
+			t.Errorf("%q: expected an error", raw)
+		}
+	}
+}
+
+func TestRouteRecord(t *testing.T) {
+	defer withOutputs("main", "siem", "archive")()
+	rawRoutes, routeDefault = []string{"log.level==audit|security:siem,archive", "log.app!=web:archive"}, []string{"main"}
+	if err := SetupRoutes(); err != nil {
+		t.Fatal(err)
+	}
+
+	for line, expected := range map[string][]string{
+		`{"log":{"level":"audit","app":"web"}}`: {"siem", "archive"},
+		`{"log":{"level":"info","app":"db"}}`:   {"archive"},
+		`{"log":{"level":"info"}}`:              {"archive"},
+		`{"log":{"level":"info","app":"web"}}`:  {"main"},
+	} {
+		if got := RouteRecord(NewFields([]byte(line))); !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s: expected %v, got %v", line, expected, got)
+		}
+	}
+
+	routeDefault = []string{"none"}
+	routes = nil
+	if err := SetupRoutes(); err != nil {
+		t.Fatal(err)
+	}
+	if got := RouteRecord(NewFields([]byte(`{"log":{"level":"info","app":"web"}}`))); got == nil || len(got) != 0 {
+		t.Errorf("expected the record to be dropped, got %v", got)
+	}
+}
@@ -0,0 +1,371 @@
+/*
+bilies-go - Bulk Insert Logs Into ElasticSearch
+Copyright (C) 2016 Adirelle <adirelle@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+/*
+
+AWS request signing
+
+Requests can be signed using AWS Signature Version 4, e.g. to send to an Amazon OpenSearch Service domain.
+
+The credentials are taken from the first available source:
+
+	1. the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables,
+	2. the web identity token file designated by AWS_WEB_IDENTITY_TOKEN_FILE, to assume the role AWS_ROLE_ARN,
+	3. the shared credentials file (AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials), using the
+	   profile AWS_PROFILE or "default".
+
+The following switches control request signing. They can be set for each output, e.g. to sign only the requests
+sent to an Amazon OpenSearch Service domain while another output sends to a self-hosted cluster:
+
+	--aws-sigv4 [default: false]
+		Sign the requests.
+
+	--aws-region=STRING [default: $AWS_REGION]
+		AWS region of the domain.
+
+	--aws-service=STRING [default: es]
+		AWS service name: "es" for OpenSearch Service, "aoss" for OpenSearch Serverless.
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+const (
+	awsAlgorithm  = "AWS4-HMAC-SHA256"
+	awsTimeFormat = "20060102T150405Z"
+	awsDateFormat = "20060102"
+)
+
+var (
+	awsSigV4   bool
+	awsRegion  string
+	awsService = "es"
+)
+
+func init() {
+	pflag.BoolVar(&awsSigV4, "aws-sigv4", awsSigV4, "Sign requests with AWS Signature Version 4")
+	pflag.StringVar(&awsRegion, "aws-region", awsRegion, "AWS region")
+	pflag.StringVar(&awsService, "aws-service", awsService, "AWS service name")
+}
+
+// AWSCredentials are the credentials used to sign requests.
+type AWSCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      time.Time
+}
+
+// Expired checks whether the credentials should be renewed.
+func (c AWSCredentials) Expired(now time.Time) bool {
+	return !c.Expiration.IsZero() && now.Add(5*time.Minute).After(c.Expiration)
+}
+
+// AWSSigner signs requests.
+type AWSSigner struct {
+	Region  string
+	Service string
+
+	// GetCredentials returns the credentials to use.
+	GetCredentials func() (AWSCredentials, error)
+
+	current AWSCredentials
+	sync.Mutex
+}
+
+// NewAWSSigner creates a signer for the region and the service, using the environment for the region if empty.
+func NewAWSSigner(region string, service string) (*AWSSigner, error) {
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		return nil, errors.New("No AWS region, use --aws-region")
+	}
+	return &AWSSigner{Region: region, Service: service, GetCredentials: AWSDefaultCredentials}, nil
+}
+
+// Sign signs the request.
+func (s *AWSSigner) Sign(req *http.Request, body []byte, now time.Time) error {
+	creds, err := s.credentials(now)
+	if err != nil {
+		return err
+	}
+
+	now = now.UTC()
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", now.Format(awsTimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	canonicalRequest, signedHeaders := awsCanonicalRequest(req, hex.EncodeToString(payloadHash[:]))
+	req.Header.Set("Authorization", s.authorization(creds, now, canonicalRequest, signedHeaders))
+	return nil
+}
+
+// authorization returns the Authorization header of a canonical request.
+func (s *AWSSigner) authorization(creds AWSCredentials, now time.Time, canonicalRequest, signedHeaders string) string {
+	scope := strings.Join([]string{now.Format(awsDateFormat), s.Region, s.Service, "aws4_request"}, "/")
+	stringToSign := awsStringToSign(now, scope, canonicalRequest)
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{now.Format(awsDateFormat), s.Region, s.Service, "aws4_request"} {
+		key = awsHMAC(key, part)
+	}
+	signature := hex.EncodeToString(awsHMAC(key, stringToSign))
+
+	return fmt.Sprintf(
+		"%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		awsAlgorithm, creds.AccessKeyID, scope, signedHeaders, signature,
+	)
+}
+
+// awsCanonicalRequest returns the canonical request and the list of signed headers.
+func awsCanonicalRequest(req *http.Request, payloadHash string) (string, string) {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for _, name := range []string{"X-Amz-Date", "X-Amz-Content-Sha256", "X-Amz-Security-Token", "Content-Type"} {
+		if v := req.Header.Get(name); v != "" {
+			headers[strings.ToLower(name)] = strings.TrimSpace(v)
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	return strings.Join([]string{
+		req.Method,
+		awsCanonicalPath(req.URL),
+		awsCanonicalQuery(req.URL),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n"), signedHeaders
+}
+
+func awsStringToSign(now time.Time, scope, canonicalRequest string) string {
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	return strings.Join([]string{awsAlgorithm, now.Format(awsTimeFormat), scope, hex.EncodeToString(requestHash[:])}, "\n")
+}
+
+// credentials returns the cached credentials, renewing them if needed.
+func (s *AWSSigner) credentials(now time.Time) (AWSCredentials, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.current.AccessKeyID == "" || s.current.Expired(now) {
+		creds, err := s.GetCredentials()
+		if err != nil {
+			return creds, err
+		}
+		s.current = creds
+	}
+	return s.current, nil
+}
+
+func awsHMAC(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// awsEscape encodes a string as required by AWS: everything but unreserved characters is escaped.
+func awsEscape(s string) string {
+	var buf bytes.Buffer
+	for _, c := range []byte(s) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+// awsCanonicalPath encodes each segment of the already-escaped path once more.
+func awsCanonicalPath(u *url.URL) string {
+	path := u.EscapedPath()
+	if path == "" {
+		return "/"
+	}
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		segments[i] = awsEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+func awsCanonicalQuery(u *url.URL) string {
+	query := u.Query()
+	pairs := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, v := range values {
+			pairs = append(pairs, awsEscape(name)+"="+awsEscape(v))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// AWSDefaultCredentials looks for credentials in the environment, the web identity token file and the shared
+// credentials file.
+func AWSDefaultCredentials() (AWSCredentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return AWSCredentials{
+			AccessKeyID:     id,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+	if tokenFile := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"); tokenFile != "" {
+		return AWSWebIdentityCredentials(tokenFile, os.Getenv("AWS_ROLE_ARN"))
+	}
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return AWSCredentials{}, err
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	return AWSSharedCredentials(path, profile)
+}
+
+// AWSSharedCredentials reads credentials from a shared credentials file.
+func AWSSharedCredentials(path string, profile string) (creds AWSCredentials, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	var section string
+	for s := bufio.NewScanner(f); s.Scan(); {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' && line[len(line)-1] == ']' {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		if section != profile {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(kv[1])
+		switch strings.TrimSpace(kv[0]) {
+		case "aws_access_key_id":
+			creds.AccessKeyID = value
+		case "aws_secret_access_key":
+			creds.SecretAccessKey = value
+		case "aws_session_token":
+			creds.SessionToken = value
+		}
+	}
+	if creds.AccessKeyID == "" {
+		err = fmt.Errorf("No credentials for profile %q in %q", profile, path)
+	}
+	return
+}
+
+// AWSWebIdentityCredentials assumes a role using a web identity token.
+func AWSWebIdentityCredentials(tokenFile string, roleARN string) (creds AWSCredentials, err error) {
+	token, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_STS")
+	if endpoint == "" {
+		endpoint = "https://sts.amazonaws.com/"
+	}
+	sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if sessionName == "" {
+		sessionName = fmt.Sprintf("bilies-go-%d", time.Now().Unix())
+	}
+
+	stsClient := http.Client{Timeout: 30 * time.Second}
+	resp, err := stsClient.PostForm(endpoint, url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {roleARN},
+		"RoleSessionName":  {sessionName},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	})
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return creds, fmt.Errorf("AssumeRoleWithWebIdentity failed: %s", resp.Status)
+	}
+
+	var result struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err = xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return
+	}
+	logger.Infof("Assumed role %s, credentials expire at %s", roleARN, result.Credentials.Expiration)
+	return AWSCredentials(result.Credentials), nil
+}
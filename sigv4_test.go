@@ -0,0 +1,209 @@
+/*
+bilies-go - Bulk Insert Logs Into ElasticSearch
+Copyright (C) 2016 Adirelle <adirelle@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The example of the AWS documentation, signing a ListUsers request to IAM.
+var (
+	awsExampleTime  = time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	awsExampleCreds = AWSCredentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+	awsExampleSigner = &AWSSigner{
+		Region:         "us-east-1",
+		Service:        "iam",
+		GetCredentials: func() (AWSCredentials, error) { return awsExampleCreds, nil },
+	}
+)
+
+const (
+	awsExampleEmptyHash        = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	awsExampleCanonicalRequest = "GET\n" +
+		"/\n" +
+		"Action=ListUsers&Version=2010-05-08\n" +
+		"content-type:application/x-www-form-urlencoded; charset=utf-8\n" +
+		"host:iam.amazonaws.com\n" +
+		"x-amz-date:20150830T123600Z\n" +
+		"\n" +
+		"content-type;host;x-amz-date\n" +
+		awsExampleEmptyHash
+	awsExampleStringToSign = "AWS4-HMAC-SHA256\n" +
+		"20150830T123600Z\n" +
+		"20150830/us-east-1/iam/aws4_request\n" +
+		"f536975d06c0309214f805bb90ccff089219ecd68b2577efef23edd43b7e1a59"
+	awsExampleAuthorization = "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, " +
+		"SignedHeaders=content-type;host;x-amz-date, " +
+		"Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"
+)
+
+func TestAWSSignerExample(t *testing.T) {
+	req, _ := http.NewRequest("GET", "https://iam.amazonaws.com/?Version=2010-05-08&Action=ListUsers", nil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	req.Header.Set("X-Amz-Date", "20150830T123600Z")
+
+	canonicalRequest, signedHeaders := awsCanonicalRequest(req, awsExampleEmptyHash)
+	if canonicalRequest != awsExampleCanonicalRequest {
+		t.Errorf("canonical request:\nexpected %q\ngot      %q", awsExampleCanonicalRequest, canonicalRequest)
+	}
+	if signedHeaders != "content-type;host;x-amz-date" {
+		t.Errorf("unexpected signed headers %q", signedHeaders)
+	}
+
+	stringToSign := awsStringToSign(awsExampleTime, "20150830/us-east-1/iam/aws4_request", canonicalRequest)
+	if stringToSign != awsExampleStringToSign {
+		t.Errorf("string to sign:\nexpected %q\ngot      %q", awsExampleStringToSign, stringToSign)
+	}
+
+	auth := awsExampleSigner.authorization(awsExampleCreds, awsExampleTime, canonicalRequest, signedHeaders)
+	if auth != awsExampleAuthorization {
+		t.Errorf("authorization:\nexpected %q\ngot      %q", awsExampleAuthorization, auth)
+	}
+}
+
+func TestAWSCanonicalPathAndQuery(t *testing.T) {
+	for raw, expected := range map[string]string{
+		"http://h":                       "/ ",
+		"http://h/logs-2016.10.01/_bulk": "/logs-2016.10.01/_bulk ",
+		"http://h/a%20b/c":               "/a%2520b/c ",
+		"http://h/?b=2&a=1&a=0":          "/ a=0&a=1&b=2",
+		"http://h/?q=a+b&x=%2F~":         "/ q=a%20b&x=%2F~",
+	} {
+		req, _ := http.NewRequest("GET", raw, nil)
+		if got := awsCanonicalPath(req.URL) + " " + awsCanonicalQuery(req.URL); got != expected {
+			t.Errorf("%s: expected %q, got %q", raw, expected, got)
+		}
+	}
+}
+
+// TestAWSSignerStub sends a signed request to a stub, which checks the payload hash and the signature.
+func TestAWSSignerStub(t *testing.T) {
+	creds := awsExampleCreds
+	creds.SessionToken = "session-token"
+	signer := &AWSSigner{
+		Region:         "eu-west-1",
+		Service:        "es",
+		GetCredentials: func() (AWSCredentials, error) { return creds, nil },
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		now, err := time.Parse(awsTimeFormat, r.Header.Get("X-Amz-Date"))
+		if err != nil {
+			http.Error(w, "invalid X-Amz-Date", http.StatusForbidden)
+			return
+		}
+		payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+		if payloadHash != awsHashHex(body) {
+			http.Error(w, "payload hash mismatch", http.StatusForbidden)
+			return
+		}
+		if r.Header.Get("X-Amz-Security-Token") != creds.SessionToken {
+			http.Error(w, "invalid security token", http.StatusForbidden)
+			return
+		}
+		canonicalRequest, signedHeaders := awsCanonicalRequest(r, payloadHash)
+		if r.Header.Get("Authorization") != signer.authorization(creds, now, canonicalRequest, signedHeaders) {
+			http.Error(w, "signature mismatch", http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	body := []byte(`{"index":{}}` + "\n" + `{"message":"a b"}` + "\n")
+	req, _ := http.NewRequest("POST", server.URL+"/logs-2016.10.01/_bulk?refresh=false", strings.NewReader(string(body)))
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if err := signer.Sign(req, body, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		t.Fatalf("rejected by the stub: %s", msg)
+	}
+
+	// The stub must reject a tampered request
+	req, _ = http.NewRequest("POST", server.URL+"/logs-2016.10.01/_bulk?refresh=false", strings.NewReader(string(body)))
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if err := signer.Sign(req, body, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	req.URL.Path = "/other/_bulk"
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected the stub to reject the tampered request, got %d", resp.StatusCode)
+	}
+}
+
+func awsHashHex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// TestAWSSignerPerOutput checks that only the requests of the outputs which enable signing are signed.
+func TestAWSSignerPerOutput(t *testing.T) {
+	oldRawOutputOptions := rawOutputOptions
+	defer func() { rawOutputOptions = oldRawOutputOptions }()
+	rawOutputOptions = []string{"aws:aws-sigv4=true", "aws:aws-region=eu-west-1", "aws:aws-service=aoss"}
+
+	signed, unsigned := NewOutput("aws", nil), NewOutput("self-hosted", nil)
+	if err := SetOutputOptions([]*Output{signed, unsigned}); err != nil {
+		t.Fatal(err)
+	}
+	if !signed.awsSigV4 || signed.awsRegion != "eu-west-1" || signed.awsService != "aoss" {
+		t.Errorf("expected the options to be set for %s, got %v, %q, %q", signed, signed.awsSigV4, signed.awsRegion, signed.awsService)
+	}
+	if unsigned.awsSigV4 {
+		t.Errorf("expected no signing for %s", unsigned)
+	}
+
+	for signer, expected := range map[*AWSSigner]bool{awsExampleSigner: true, nil: false} {
+		u, err := ParseBackendURL("http://localhost:9200")
+		if err != nil {
+			t.Fatal(err)
+		}
+		u.pool = &BackendURLPool{credentials: &Credentials{}, signer: signer}
+		req, err := u.NewRequest("GET", "_cluster/health", nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.HasPrefix(req.Header.Get("Authorization"), awsAlgorithm); got != expected {
+			t.Errorf("signer %v: expected signed=%v, got %v", signer, expected, got)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+/*
+bilies-go - Bulk Insert Logs Into ElasticSearch
+Copyright (C) 2016 Adirelle <adirelle@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+/*
+
+TLS
+
+The following switches control the TLS connections to the ElasticSearch servers:
+
+	--tls-ca=STRING [default: none]
+		PEM file of the certificate authorities used to verify the servers, instead of the system ones.
+
+	--tls-cert=STRING [default: none]
+		PEM file of the client certificate, for mutual TLS.
+
+	--tls-key=STRING [default: none]
+		PEM file of the private key of the client certificate.
+
+	--tls-server-name=STRING [default: none]
+		Server name sent in the SNI extension and checked against the server certificates, instead of the hostname.
+
+	--tls-min-version=(1.0|1.1|1.2|1.3) [default: 1.2]
+		Minimum TLS version.
+
+	--tls-insecure-skip-verify [default: false]
+		Do not verify the server certificates. Do not use it in production.
+
+	--tls-pin=STRING,... [default: none]
+		SHA-256 fingerprints of accepted certificates, in hexadecimal. One of the certificates presented by
+		the server must match one of them.
+
+Sending HUP to bilies-go causes the certificate files to be reloaded.
+*/
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/pflag"
+)
+
+var (
+	tlsCA                 string
+	tlsCert               string
+	tlsKey                string
+	tlsServerName         string
+	tlsMinVersion         = "1.2"
+	tlsInsecureSkipVerify bool
+	tlsPins               []string
+
+	tlsVersions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+)
+
+func init() {
+	pflag.StringVar(&tlsCA, "tls-ca", tlsCA, "PEM file of the certificate authorities")
+	pflag.StringVar(&tlsCert, "tls-cert", tlsCert, "PEM file of the client certificate")
+	pflag.StringVar(&tlsKey, "tls-key", tlsKey, "PEM file of the client private key")
+	pflag.StringVar(&tlsServerName, "tls-server-name", tlsServerName, "Expected server name")
+	pflag.StringVar(&tlsMinVersion, "tls-min-version", tlsMinVersion, "Minimum TLS version: 1.0 | 1.1 | 1.2 | 1.3")
+	pflag.BoolVar(&tlsInsecureSkipVerify, "tls-insecure-skip-verify", tlsInsecureSkipVerify, "Do not verify server certificates")
+	pflag.StringSliceVar(&tlsPins, "tls-pin", tlsPins, "SHA-256 fingerprints of accepted server certificates")
+
+	AddBackgroundTask("TLS reloader", TLSReloader)
+}
+
+// NewTLSConfig creates the TLS configuration of the requester, loading the certificate files.
+func NewTLSConfig() (*tls.Config, error) {
+	minVersion, found := tlsVersions[tlsMinVersion]
+	if !found {
+		return nil, fmt.Errorf("Invalid TLS version: %q", tlsMinVersion)
+	}
+
+	config := &tls.Config{
+		ServerName:         tlsServerName,
+		MinVersion:         minVersion,
+		InsecureSkipVerify: tlsInsecureSkipVerify,
+	}
+
+	if tlsCA != "" {
+		pem, err := ioutil.ReadFile(tlsCA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificate found in %q", tlsCA)
+		}
+	}
+
+	if (tlsCert == "") != (tlsKey == "") {
+		return nil, errors.New("--tls-cert and --tls-key must be used together")
+	}
+	if tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(tlsPins) > 0 {
+		pins := make(map[string]bool, len(tlsPins))
+		for _, pin := range tlsPins {
+			pin = strings.ToLower(strings.Replace(pin, ":", "", -1))
+			if b, err := hex.DecodeString(pin); err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("Invalid certificate fingerprint: %q", pin)
+			}
+			pins[pin] = true
+		}
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			return VerifyPins(cs, pins)
+		}
+	}
+
+	return config, nil
+}
+
+// VerifyPins checks that one of the server certificates matches one of the pinned fingerprints.
+func VerifyPins(cs tls.ConnectionState, pins map[string]bool) error {
+	for _, c := range cs.PeerCertificates {
+		sum := sha256.Sum256(c.Raw)
+		if pins[hex.EncodeToString(sum[:])] {
+			return nil
+		}
+	}
+	return fmt.Errorf("No server certificate matches the pinned fingerprints")
+}
+
+// TLSReloader reloads the certificate files on SIGHUP.
+func TLSReloader() {
+	if tlsCA == "" && tlsCert == "" {
+		return
+	}
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	defer signal.Stop(sigChan)
+	for {
+		select {
+		case <-sigChan:
+			if err := transport.Reload(); err == nil {
+				logger.Notice("Received SIGHUP, reloaded TLS certificates")
+			} else {
+				logger.Errorf("Could not reload TLS certificates, keeping the previous ones: %s", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
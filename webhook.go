@@ -0,0 +1,89 @@
+/*
+bilies-go - Bulk Insert Logs Into ElasticSearch
+Copyright (C) 2016 Adirelle <adirelle@gmail.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/url"
+)
+
+func init() {
+	AddProtocol("webhook", WebhookProtocol{})
+}
+
+// WebhookProtocol posts the documents to an URL, as a JSON array.
+//
+// Any 2xx status is a success. The requests are retried on network, 408, 429 and 5xx errors, and the batchs are
+// split on 400, 413 and 422 errors.
+type WebhookProtocol struct{}
+
+func (WebhookProtocol) Check(o *Output) error {
+	if o.sniff {
+		return errors.New("Webhooks do not support sniffing")
+	}
+	return nil
+}
+
+func (WebhookProtocol) Start(o *Output) {}
+
+func (WebhookProtocol) URL(o *Output, u *BackendURL) string {
+	return u.ExactURL()
+}
+
+func (WebhookProtocol) Request(o *Output, buf *IndexedBuffer, i, j int) ([]byte, http.Header, error) {
+	var body bytes.Buffer
+	body.WriteByte('[')
+	for k, rec := range buf.Records(i, j) {
+		if k > 0 {
+			body.WriteByte(',')
+		}
+		body.WriteString(rec.Document)
+	}
+	body.WriteByte(']')
+	return body.Bytes(), http.Header{"Content-Type": {"application/json"}}, nil
+}
+
+func (WebhookProtocol) Response(resp *http.Response) (interface{}, error) {
+	if msg := readErrorBody(resp); msg != "" {
+		return nil, errors.New(msg)
+	}
+	return nil, nil
+}
+
+func (WebhookProtocol) Report(o *Output, buf *IndexedBuffer, i int, result interface{}) []int {
+	return nil
+}
+
+func (WebhookProtocol) IsBackendError(err error) bool {
+	switch e := err.(type) {
+	case HTTPError:
+		return e.Temporary() || e.StatusCode == http.StatusRequestTimeout
+	case *url.Error:
+		return true
+	}
+	return false
+}
+
+func (WebhookProtocol) IsRejection(err error) bool {
+	e, ok := err.(HTTPError)
+	return ok && (e.StatusCode == http.StatusBadRequest || e.StatusCode == http.StatusRequestEntityTooLarge ||
+		e.StatusCode == http.StatusUnprocessableEntity)
+}